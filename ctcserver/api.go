@@ -12,46 +12,229 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
 	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctcapi"
 )
 
 type api struct {
 	ctcapi ctcapi.CTCAPI
+
+	// consoleCommands are the operator command verbs that may be issued.
+	consoleCommands []string
+
+	// consoleWatcher reads the console for consoleStream subscribers.
+	consoleWatcher *ctcapi.ConsoleWatcher
 }
 
+// errorResponse is the JSON body of every error response. Code is one of the
+// error codes below, and is the field clients should use to distinguish
+// errors, since the Error message may change.
 type errorResponse struct {
-	Error string `json:"error"`
+	Error          string  `json:"error"`
+	Code           string  `json:"code"`
+	Dataset        string  `json:"dataset,omitempty"`
+	ResultCode     *uint32 `json:"result_code,omitempty"`
+	AdditionalCode *uint32 `json:"additional_code,omitempty"`
+	Record         int     `json:"record,omitempty"`
+	LinkState      string  `json:"link_state,omitempty"`
+}
+
+// Error codes for errorResponse.Code.
+const (
+	errCodeInvalidRequest = "invalid_request"
+	errCodeNotCataloged   = "not_cataloged"
+	errCodeNotOnVolume    = "dataset_not_found"
+	errCodeNotMounted     = "volume_not_mounted"
+	errCodeMemberNotFound = "member_not_found"
+	errCodeDatasetInUse   = "dataset_in_use"
+	errCodeDatasetExists  = "dataset_exists"
+	errCodeJobRejected    = "job_rejected"
+	errCodeNotAllowed     = "command_not_allowed"
+	errCodeNotAuthorized  = "not_authorized"
+	errCodeUnsupported    = "unsupported"
+	errCodeMVS            = "mvs_error"
+	errCodeLinkDown       = "link_down"
+	errCodeBusy           = "busy"
+	errCodeTimeout        = "timeout"
+	errCodeInternal       = "internal_error"
+)
+
+// requireLink rejects requests with 503 Service Unavailable while the CTC
+// link to Hercules is down, rather than letting them fail part way through.
+func (app *api) requireLink(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		state := app.ctcapi.LinkState()
+		if state != ctc.StateConnected {
+			return c.JSON(http.StatusServiceUnavailable, errorResponse{
+				Error:     "CTC link to Hercules is not connected",
+				Code:      errCodeLinkDown,
+				LinkState: state.String(),
+			})
+		}
+		return next(c)
+	}
+}
+
+// ctcError sends the JSON error response for an error returned by the CTC
+// API for a request concerning dataset dsn (which may be empty). The HTTP
+// status is chosen based on the type of error:
+//
+//   - 400 Bad Request if the request parameters were invalid
+//   - 403 Forbidden if CTCSERV isn't APF-authorized to issue operator
+//     commands
+//   - 404 Not Found if the dataset isn't cataloged or isn't on the given
+//     volume, the volume isn't mounted, or the member doesn't exist
+//   - 409 Conflict if the dataset is in use by another job, or the name of
+//     a dataset being allocated or the new name of a dataset or member being
+//     renamed is already in use
+//   - 422 Unprocessable Entity if JES2 rejected a submitted job
+//   - 501 Not Implemented if CTCSERV doesn't support the command
+//   - 503 Service Unavailable if the link dropped during the request, or
+//     every CTC adapter pair stayed busy until the request timed out
+//   - 504 Gateway Timeout if CTCSERV didn't respond in time
+//   - 500 Internal Server Error for anything else
+func (app *api) ctcError(c echo.Context, err error, dsn string) error {
+	status, resp := app.errorResponse(err, dsn)
+	return c.JSON(status, resp)
+}
+
+// errorResponse returns the HTTP status and response body for an error from
+// the CTC API, as described for ctcError.
+func (app *api) errorResponse(err error, dsn string) (int, errorResponse) {
+	status := http.StatusInternalServerError
+	resp := errorResponse{
+		Error:   err.Error(),
+		Code:    errCodeInternal,
+		Dataset: strings.ToUpper(dsn),
+	}
+
+	var timeoutErr *ctc.TimeoutError
+	var resultErr *ctcapi.ResultError
+	var rejectedErr *ctcapi.JobRejectedError
+	switch {
+	case errors.As(err, &rejectedErr):
+		status, resp.Code = http.StatusUnprocessableEntity, errCodeJobRejected
+	case errors.Is(err, ctcapi.ErrInvalidInput):
+		status, resp.Code = http.StatusBadRequest, errCodeInvalidRequest
+	case errors.Is(err, ctcapi.ErrUnsupported):
+		status, resp.Code = http.StatusNotImplemented, errCodeUnsupported
+	case errors.As(err, &timeoutErr) && timeoutErr.Timeout():
+		status, resp.Code = http.StatusGatewayTimeout, errCodeTimeout
+		resp.LinkState = app.ctcapi.LinkState().String()
+	case errors.Is(err, ctc.ErrNotConnected):
+		status, resp.Code = http.StatusServiceUnavailable, errCodeLinkDown
+		resp.LinkState = app.ctcapi.LinkState().String()
+	case errors.Is(err, ctcapi.ErrBusy):
+		status, resp.Code = http.StatusServiceUnavailable, errCodeBusy
+	case errors.Is(err, context.DeadlineExceeded):
+		status, resp.Code = http.StatusGatewayTimeout, errCodeTimeout
+	case errors.As(err, &resultErr):
+		resp.ResultCode = &resultErr.Code
+		resp.AdditionalCode = &resultErr.Additional
+		resp.Record = resultErr.Record
+		switch {
+		case resultErr.NotCataloged():
+			status, resp.Code = http.StatusNotFound, errCodeNotCataloged
+		case resultErr.NotOnVolume():
+			status, resp.Code = http.StatusNotFound, errCodeNotOnVolume
+		case resultErr.VolumeNotMounted():
+			status, resp.Code = http.StatusNotFound, errCodeNotMounted
+		case resultErr.MemberNotFound():
+			status, resp.Code = http.StatusNotFound, errCodeMemberNotFound
+		case resultErr.InUse():
+			status, resp.Code = http.StatusConflict, errCodeDatasetInUse
+		case resultErr.Exists():
+			status, resp.Code = http.StatusConflict, errCodeDatasetExists
+		case resultErr.NotAuthorized():
+			status, resp.Code = http.StatusForbidden, errCodeNotAuthorized
+		default:
+			resp.Code = errCodeMVS
+		}
+	}
+
+	return status, resp
 }
 
 func (app *api) dslist(c echo.Context) error {
 	prefix := c.Param("prefix")
 
-	results, err := app.ctcapi.GetDSList(prefix)
+	results, err := app.ctcapi.GetDSList(c.Request().Context(), prefix)
 	if err != nil {
 		log.Error().Err(err).Msgf("CTC API error reading dslist for '%s'",
 			prefix)
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+		return app.ctcError(c, err, prefix)
 	}
 
 	return c.JSON(http.StatusOK, results)
 }
 
+// vtoc lists the datasets on a volume from its VTOC.
+func (app *api) vtoc(c echo.Context) error {
+	volser := c.Param("volser")
+
+	results, err := app.ctcapi.GetVTOC(c.Request().Context(), volser)
+	if err != nil {
+		log.Error().Err(err).Msgf("CTC API error reading VTOC of '%s'",
+			volser)
+		return app.ctcError(c, err, "")
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// volumes lists the DASD devices and the volumes mounted on them.
+func (app *api) volumes(c echo.Context) error {
+	results, err := app.ctcapi.ListVolumes(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("CTC API error listing volumes")
+		return app.ctcError(c, err, "")
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// system returns information about the MVS system and its active address
+// spaces.
+func (app *api) system(c echo.Context) error {
+	info, err := app.ctcapi.GetSystemInfo(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("CTC API error getting system information")
+		return app.ctcError(c, err, "")
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
 func (app *api) mbrlist(c echo.Context) error {
 	pdsName := c.Param("pdsName")
+	volume := c.QueryParam("volume")
 
-	results, err := app.ctcapi.GetMemberList(pdsName)
+	var results any
+	var err error
+	if c.QueryParam("stats") == "true" {
+		results, err = app.ctcapi.GetMemberInfo(c.Request().Context(),
+			pdsName, volume)
+	} else {
+		results, err = app.ctcapi.GetMemberList(c.Request().Context(),
+			pdsName, volume)
+	}
 	if err != nil {
 		log.Error().Err(err).Msgf("CTC API error reading member list for '%s'",
 			pdsName)
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+		return app.ctcError(c, err, pdsName)
 	}
 
 	return c.JSON(http.StatusOK, results)
@@ -59,6 +242,7 @@ func (app *api) mbrlist(c echo.Context) error {
 
 func (app *api) read(c echo.Context) error {
 	dsn := c.Param("dsn")
+	volume := c.QueryParam("volume")
 	ebcdicQueryParam := c.QueryParam("ebcdic")
 
 	raw := false
@@ -66,30 +250,62 @@ func (app *api) read(c echo.Context) error {
 		raw = true
 	}
 
-	results, err := app.ctcapi.Read(dsn, raw)
-	if err != nil {
-		log.Error().Err(err).Msgf("CTC API error reading dataset '%s'", dsn)
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+	// ASCII-translated output is one line per record, raw output is the
+	// records back-to-back.
+	contentType := echo.MIMETextPlainCharsetUTF8
+	if raw {
+		contentType = echo.MIMEOctetStream
 	}
 
-	// ASCII-translated output
-	if !raw {
-		var output strings.Builder
-		for _, record := range results {
-			output.WriteString(string(record))
-			output.WriteString("\n")
-		}
-		return c.String(http.StatusOK, output.String())
+	// We stream the records to the client as they arrive. The response
+	// headers aren't sent until the first record arrives, so if the read
+	// fails before then we can still send a proper error response.
+	//
+	// If the client goes away part way through, it's better to let
+	// ReadStream discard the rest of the records than to abandon the read
+	// and reset the CTC link, so the read isn't canceled with the request.
+	reqCtx := c.Request().Context()
+	ctx := context.WithoutCancel(reqCtx)
+	resp := c.Response()
+	err := app.ctcapi.ReadStream(ctx, dsn, volume, raw,
+		func(record []byte) error {
+			if err := reqCtx.Err(); err != nil {
+				return err
+			}
+			if !resp.Committed {
+				resp.Header().Set(echo.HeaderContentType, contentType)
+				resp.WriteHeader(http.StatusOK)
+			}
+			if _, err := resp.Write(record); err != nil {
+				return err
+			}
+			if !raw {
+				if _, err := resp.Write([]byte("\n")); err != nil {
+					return err
+				}
+			}
+			resp.Flush()
+			return nil
+		})
+	if err != nil && !resp.Committed {
+		log.Error().Err(err).Msgf("CTC API error reading dataset '%s'", dsn)
+		return app.ctcError(c, err, dsn)
+	}
+	if err != nil {
+		// Too late to report the error with a status code, so we abort the
+		// response; the client sees the chunked response end prematurely
+		// rather than a complete but truncated dataset.
+		log.Error().Err(err).Msgf("CTC API error streaming dataset '%s'",
+			dsn)
+		panic(http.ErrAbortHandler)
 	}
 
-	// Raw binary output
-	var output bytes.Buffer
-	for _, record := range results {
-		output.Write(record)
+	// An empty dataset
+	if !resp.Committed {
+		return c.Blob(http.StatusOK, contentType, nil)
 	}
-	return c.Blob(http.StatusOK, "application/octet-stream", output.Bytes())
 
+	return nil
 }
 
 func (app *api) submit(c echo.Context) error {
@@ -104,46 +320,377 @@ func (app *api) submit(c echo.Context) error {
 		return err
 	}
 
-	result, err := app.ctcapi.Submit(records)
+	result, err := app.ctcapi.Submit(c.Request().Context(), records)
 	if err != nil {
 		log.Error().Err(err).Msg("CTC API error submitting job")
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+		return app.ctcError(c, err, "")
 	}
 
 	return c.String(http.StatusOK, result)
 }
 
+// write replaces the records of a dataset with the lines of the request
+// body, or with ebcdic=true, with the body as it is.
 func (app *api) write(c echo.Context) error {
 	dsn := c.Param("dsn")
-	var records []string
-	scanner := bufio.NewScanner(c.Request().Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Trace().Msgf("Scanned one record: %s", line)
-		records = append(records, line)
-	}
-	if err := scanner.Err(); err != nil {
-		return err
+	opts := ctcapi.WriteOptions{
+		Staged: c.QueryParam("staged") == "true",
+		Append: c.QueryParam("append") == "true",
+		Volume: c.QueryParam("volume"),
 	}
 
-	err := app.ctcapi.Write(dsn, records)
+	var result *ctcapi.WriteResult
+	var err error
+	if c.QueryParam("ebcdic") == "true" {
+		data, readErr := io.ReadAll(c.Request().Body)
+		if readErr != nil {
+			return readErr
+		}
+		result, err = app.ctcapi.WriteRaw(c.Request().Context(), dsn, data,
+			opts)
+	} else {
+		var records []string
+		scanner := bufio.NewScanner(c.Request().Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			log.Trace().Msgf("Scanned one record: %s", line)
+			records = append(records, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		result, err = app.ctcapi.Write(c.Request().Context(), dsn, records,
+			opts)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("CTC API error writing dataset")
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+		return app.ctcError(c, err, dsn)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// allocate creates a new dataset with the attributes in the JSON request
+// body, and responds with its description in the same form as dslist.
+func (app *api) allocate(c echo.Context) error {
+	dsn := c.Param("dsn")
+
+	var alloc ctcapi.Allocation
+	if err := decodeJSON(c, &alloc); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error:   "invalid allocation request: " + err.Error(),
+			Code:    errCodeInvalidRequest,
+			Dataset: strings.ToUpper(dsn),
+		})
+	}
+
+	result, err := app.ctcapi.Allocate(c.Request().Context(), dsn, alloc)
+	if err != nil {
+		log.Error().Err(err).Msg("CTC API error allocating dataset")
+		return app.ctcError(c, err, dsn)
+	}
+
+	return c.JSON(http.StatusCreated, result)
+}
+
+// maintResponse is the JSON body of a successful delete, rename or alias
+// request.
+type maintResponse struct {
+	Action  string `json:"action"`
+	Dataset string `json:"dataset"`
+	NewName string `json:"new_name,omitempty"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// splitMember splits a dataset name of the form PDS(MEMBER) into the PDS
+// and member names. The member name is empty if there isn't one.
+func splitMember(dsn string) (string, string) {
+	i := strings.IndexByte(dsn, '(')
+	if i < 0 || !strings.HasSuffix(dsn, ")") {
+		return dsn, ""
+	}
+	return dsn[:i], dsn[i+1 : len(dsn)-1]
+}
+
+// deleteDataset deletes a dataset or PDS member, or with uncatalog=true,
+// only uncatalogs a dataset.
+func (app *api) deleteDataset(c echo.Context) error {
+	dsn := c.Param("dsn")
+	dryRun := c.QueryParam("dry_run") == "true"
+	pdsName, member := splitMember(dsn)
+	ctx := c.Request().Context()
+
+	resp := maintResponse{Action: "delete", Dataset: strings.ToUpper(dsn),
+		DryRun: dryRun}
+	var err error
+	switch {
+	case c.QueryParam("uncatalog") == "true" && member != "":
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error:   "a PDS member can't be uncataloged",
+			Code:    errCodeInvalidRequest,
+			Dataset: resp.Dataset,
+		})
+	case c.QueryParam("uncatalog") == "true":
+		resp.Action = "uncatalog"
+		err = app.ctcapi.UncatalogDataset(ctx, dsn, dryRun)
+	case member != "":
+		err = app.ctcapi.DeleteMember(ctx, pdsName, member, dryRun)
+	default:
+		err = app.ctcapi.DeleteDataset(ctx, dsn, dryRun)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("CTC API error in %s of '%s'", resp.Action,
+			dsn)
+		return app.ctcError(c, err, dsn)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// renameDataset renames a dataset or PDS member to the new_name in the JSON
+// request body.
+func (app *api) renameDataset(c echo.Context) error {
+	dsn := c.Param("dsn")
+	dryRun := c.QueryParam("dry_run") == "true"
+	pdsName, member := splitMember(dsn)
+
+	var body struct {
+		NewName string `json:"new_name"`
+	}
+	if err := decodeJSON(c, &body); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error:   "invalid rename request: " + err.Error(),
+			Code:    errCodeInvalidRequest,
+			Dataset: strings.ToUpper(dsn),
+		})
+	}
+
+	var err error
+	if member != "" {
+		err = app.ctcapi.RenameMember(c.Request().Context(), pdsName, member,
+			body.NewName, dryRun)
+	} else {
+		err = app.ctcapi.RenameDataset(c.Request().Context(), dsn,
+			body.NewName, dryRun)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("CTC API error renaming '%s'", dsn)
+		return app.ctcError(c, err, dsn)
+	}
+
+	return c.JSON(http.StatusOK, maintResponse{Action: "rename",
+		Dataset: strings.ToUpper(dsn),
+		NewName: strings.ToUpper(body.NewName), DryRun: dryRun})
+}
+
+// aliasMember adds the alias in the JSON request body to a PDS member.
+func (app *api) aliasMember(c echo.Context) error {
+	dsn := c.Param("dsn")
+	dryRun := c.QueryParam("dry_run") == "true"
+	pdsName, member := splitMember(dsn)
+
+	var body struct {
+		Alias string `json:"alias"`
+	}
+	if err := decodeJSON(c, &body); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error:   "invalid alias request: " + err.Error(),
+			Code:    errCodeInvalidRequest,
+			Dataset: strings.ToUpper(dsn),
+		})
+	}
+	if member == "" {
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error:   "an alias can only be added to a PDS member",
+			Code:    errCodeInvalidRequest,
+			Dataset: strings.ToUpper(dsn),
+		})
+	}
+
+	err := app.ctcapi.AliasMember(c.Request().Context(), pdsName, member,
+		body.Alias, dryRun)
+	if err != nil {
+		log.Error().Err(err).Msgf("CTC API error adding alias to '%s'", dsn)
+		return app.ctcError(c, err, dsn)
+	}
+
+	return c.JSON(http.StatusOK, maintResponse{Action: "alias",
+		Dataset: strings.ToUpper(dsn), NewName: strings.ToUpper(body.Alias),
+		DryRun: dryRun})
+}
+
+// decodeJSON decodes the JSON request body into v, rejecting unknown fields
+// so that misspelled attributes aren't silently ignored.
+func decodeJSON(c echo.Context, v any) error {
+	decoder := json.NewDecoder(c.Request().Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// defaultConsoleWait is how long console waits for messages after issuing a
+// command when the request doesn't say.
+const defaultConsoleWait = 2
+
+// console issues an operator command, if its verb is one of those allowed by
+// the configuration, and returns the console messages that follow it.
+func (app *api) console(c echo.Context) error {
+	body := struct {
+		Command     string `json:"command"`
+		WaitSeconds *int   `json:"wait_seconds"`
+	}{}
+	if err := decodeJSON(c, &body); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse{
+			Error: "invalid console request: " + err.Error(),
+			Code:  errCodeInvalidRequest,
+		})
+	}
+	wait := defaultConsoleWait
+	if body.WaitSeconds != nil {
+		wait = *body.WaitSeconds
+	}
+
+	command := strings.ToUpper(strings.TrimSpace(body.Command))
+	if command != "" && !app.commandAllowed(command) {
+		return c.JSON(http.StatusForbidden, errorResponse{
+			Error: "command isn't in the console_commands configuration",
+			Code:  errCodeNotAllowed,
+		})
+	}
+
+	messages, err := app.ctcapi.IssueCommand(c.Request().Context(), command,
+		time.Duration(wait)*time.Second)
+	if err != nil {
+		log.Error().Err(err).Msgf("CTC API error issuing command '%s'",
+			command)
+		return app.ctcError(c, err, "")
+	}
+
+	return c.JSON(http.StatusOK, struct {
+		Command  string                  `json:"command"`
+		Messages []ctcapi.ConsoleMessage `json:"messages"`
+	}{command, messages})
+}
+
+// consoleKeepalive is how often consoleStream sends a comment to keep the
+// connection open while there are no messages.
+const consoleKeepalive = 15 * time.Second
+
+// consoleStream sends console messages as they're written, as Server-Sent
+// Events, until the client disconnects. The message_id and job query
+// parameters are comma-separated lists of message ID prefixes and job names
+// to narrow the messages down to; see ctcapi.ConsoleFilter.
+func (app *api) consoleStream(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// Check up front that CTCSERV can read the console, so that clients get
+	// an ordinary error response rather than an error event.
+	caps, err := app.ctcapi.Capabilities(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("CTC API error getting capabilities")
+		return app.ctcError(c, err, "")
+	}
+	if !slices.Contains(caps.Operations, "console") {
+		return c.JSON(http.StatusNotImplemented, errorResponse{
+			Error: fmt.Sprintf("CTCSERV version %d doesn't support the "+
+				"console command", caps.Version),
+			Code: errCodeUnsupported,
+		})
+	}
+
+	sub := app.consoleWatcher.Subscribe(ctcapi.ConsoleFilter{
+		MessageIDs: splitList(c.QueryParam("message_id")),
+		JobNames:   splitList(c.QueryParam("job")),
+	})
+	defer sub.Close()
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set(echo.HeaderCacheControl, "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+
+	keepalive := time.NewTicker(consoleKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		var buf bytes.Buffer
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepalive.C:
+			buf.WriteString(": keepalive\n\n")
+		case update := <-sub.C:
+			if update.Err != nil {
+				_, body := app.errorResponse(update.Err, "")
+				data, _ := json.Marshal(body)
+				fmt.Fprintf(&buf, "event: error\ndata: %s\n\n", data)
+			}
+			for _, msg := range update.Messages {
+				data, _ := json.Marshal(msg)
+				fmt.Fprintf(&buf, "id: %d\ndata: %s\n\n", msg.Sequence, data)
+			}
+		}
+		if _, err := resp.Write(buf.Bytes()); err != nil {
+			return nil
+		}
+		resp.Flush()
 	}
+}
 
-	return c.String(http.StatusOK, "dataset successfully saved")
+// splitList splits a comma-separated query parameter, dropping empty items.
+func splitList(param string) []string {
+	var items []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// commandAllowed reports whether the verb of an operator command is in the
+// configured list. JES2 commands are written without a space after the verb
+// (e.g. $DA is $D with the operand A), so their verb is the $ and the letter
+// after it; any other command's verb is its whole first word (e.g. D, for
+// D A,L). Commands containing a semicolon are never allowed, since it could
+// be taken to separate another command that the list doesn't allow.
+func (app *api) commandAllowed(command string) bool {
+	if strings.Contains(command, ";") {
+		return false
+	}
+
+	verb, _, _ := strings.Cut(command, " ")
+	if strings.HasPrefix(command, "$") && len(command) >= 2 {
+		verb = command[:2]
+	}
+	for _, allowed := range app.consoleCommands {
+		if verb == strings.ToUpper(allowed) {
+			return true
+		}
+	}
+	return false
 }
 
 func (app *api) quit(c echo.Context) error {
-	err := app.ctcapi.Quit()
+	err := app.ctcapi.Quit(c.Request().Context())
 	if err != nil {
 		log.Error().Err(err).Msg("CTC API error sending quit command")
-		return c.JSON(http.StatusInternalServerError,
-			errorResponse{Error: err.Error()})
+		return app.ctcError(c, err, "")
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+func (app *api) capabilities(c echo.Context) error {
+	caps, err := app.ctcapi.Capabilities(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("CTC API error getting capabilities")
+		return app.ctcError(c, err, "")
+	}
+
+	return c.JSON(http.StatusOK, caps)
+}
+
+func (app *api) adapters(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.ctcapi.Status())
+}
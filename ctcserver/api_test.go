@@ -0,0 +1,40 @@
+package main
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import "testing"
+
+func TestCommandAllowed(t *testing.T) {
+	app := api{consoleCommands: []string{"D", "$d"}}
+
+	tests := []struct {
+		command string
+		want    bool
+	}{
+		{"D A,L", true},
+		{"D", true},
+		{"DISPLAY A", false},
+		{"V 0A0,OFFLINE", false},
+		{"$DA", true},
+		{"$DJ12", true},
+		{"$D", true},
+		{"$PJES2", false},
+		{"$", false},
+		{"$DA;$PJES2", false},
+		{"D A;V 0A0,OFFLINE", false},
+	}
+
+	for _, tt := range tests {
+		if got := app.commandAllowed(tt.command); got != tt.want {
+			t.Errorf("commandAllowed(%q) = %v, want %v", tt.command, got,
+				tt.want)
+		}
+	}
+}
@@ -24,6 +24,31 @@ type configuration struct {
 	CmdRPort              uint16 `json:"cmd_remote_port"`
 	DataLPort             uint16 `json:"data_local_port"`
 	DataRPort             uint16 `json:"data_remote_port"`
+	CTCTimeout            int    `json:"ctc_timeout_seconds"`
+
+	// CTCSERVHandshake enables the CAPS handshake, which a CTCSERV from
+	// before it was added never responds to. It's on unless set to false.
+	CTCSERVHandshake *bool `json:"ctcserv_handshake"`
+
+	// ConsoleCommands lists the operator command verbs that may be issued
+	// with POST /api/console. If it is empty, no commands may be issued.
+	ConsoleCommands []string `json:"console_commands"`
+
+	// Adapters lists the ports of each pair of command and data adapters,
+	// one pair per CTCSERV task. If it is empty, the single pair given by
+	// the cmd_ and data_ port settings above is used.
+	Adapters []adapterConfig `json:"adapters"`
+}
+
+// defaultListenPort is the HTTP port used with -mock when there is no config
+// file.
+const defaultListenPort = 8370
+
+type adapterConfig struct {
+	CmdLPort  uint16 `json:"cmd_local_port"`
+	CmdRPort  uint16 `json:"cmd_remote_port"`
+	DataLPort uint16 `json:"data_local_port"`
+	DataRPort uint16 `json:"data_remote_port"`
 }
 
 func readConfig(path string) (configuration, error) {
@@ -31,7 +56,7 @@ func readConfig(path string) (configuration, error) {
 
 	f, err := os.Open(path)
 	if err != nil {
-		return c, fmt.Errorf("couldn't open config file '%s': %v", path, err)
+		return c, fmt.Errorf("couldn't open config file '%s': %w", path, err)
 	}
 	defer f.Close()
 
@@ -40,5 +65,30 @@ func readConfig(path string) (configuration, error) {
 		return c, fmt.Errorf("couldn't decode config JSON: %v", err)
 	}
 
-	return c, nil
+	return withDefaults(c), nil
+}
+
+// mockConfig is the configuration used with -mock when there is no config
+// file: one adapter pair, with everything else defaulted.
+func mockConfig() configuration {
+	return withDefaults(configuration{ListenPort: defaultListenPort})
+}
+
+// withDefaults fills in the settings that c leaves unset.
+func withDefaults(c configuration) configuration {
+	if c.CTCSERVHandshake == nil {
+		handshake := true
+		c.CTCSERVHandshake = &handshake
+	}
+
+	if len(c.Adapters) == 0 {
+		c.Adapters = []adapterConfig{{
+			CmdLPort:  c.CmdLPort,
+			CmdRPort:  c.CmdRPort,
+			DataLPort: c.DataLPort,
+			DataRPort: c.DataRPort,
+		}}
+	}
+
+	return c
 }
@@ -11,10 +11,14 @@ package ctc
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -43,28 +47,70 @@ const (
 	HerculesVersionNew
 )
 
+// State is the state of the connection between a CTC and Hercules.
+type State int
+
+const (
+	// StateDisconnected means there is no connection to Hercules, and none is
+	// being attempted.
+	StateDisconnected State = iota
+
+	// StateConnecting means we are waiting for Hercules to connect to us, or
+	// are performing the handshake with it.
+	StateConnecting
+
+	// StateConnected means both halves of the connection are established and
+	// the CTC is ready for use.
+	StateConnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	}
+	return "unknown"
+}
+
 type CTC interface {
 	Close()
 	Connect() error
-	Send(cmd CTCCmd, count uint16, data []byte) error
-	Read() (cmd CTCCmd, count uint16, data []byte, err error)
+
+	// State returns the current state of the connection to Hercules.
+	State() State
+
+	// Reset drops the current connection, if any, and treats it the same as
+	// a lost connection. It's used to resynchronize with the remote side
+	// after a failure that left the CTC state unknown.
+	Reset()
+
+	// The remaining methods give up with a *TimeoutError if ctx is canceled
+	// or its deadline passes before the operation completes.
+
+	Send(ctx context.Context, cmd CTCCmd, count uint16, data []byte) error
+	Read(ctx context.Context) (cmd CTCCmd, count uint16, data []byte,
+		err error)
 
 	// ControlWrite will send a CONTROL, wait for the SENSE from the remote
 	// side to clear the CONTROL, send the data with WRITE, and wait for the
 	// READ from the remote side. Count for the WRITE will be the length of
 	// the data.
-	ControlWrite(data []byte) error
+	ControlWrite(ctx context.Context, data []byte) error
 
-	NakedWrite(data []byte) error
+	NakedWrite(ctx context.Context, data []byte) error
 
 	// SenseWait will await a SENSE, send a CONTROL in response, then perform
 	// a READ, returning the bytes that were read.
-	SenseRead() ([]byte, error)
+	SenseRead(ctx context.Context) ([]byte, error)
 }
 
 // ErrAlreadyConnected is the error returned by Connect when at least half of
-// the connection is already established. Call Close to reset the CTC
-// connection before trying to connect again.
+// the connection is already established, or a reconnection is in progress.
+// Call Close to reset the CTC connection before trying to connect again.
 var ErrAlreadyConnected = errors.New("already connected")
 
 // ErrInvalidVersion is the error returned by New when the version parameter
@@ -72,19 +118,63 @@ var ErrAlreadyConnected = errors.New("already connected")
 var ErrInvalidVersion = errors.New("invalid Hercules version")
 
 // ErrNotConnected is the error returned when a send or receive operation is
-// attempted on a CTC connection that is not connected.
+// attempted on a CTC connection that is not connected. It is also wrapped by
+// the error returned when the connection is lost during an operation.
 var ErrNotConnected = errors.New("not connected")
 
+// TimeoutError is the error returned when a send or receive operation is
+// abandoned because its context was canceled or its deadline passed. The
+// remote side is left part way through a CCW exchange, so the connection is
+// reset just as if it had been lost, and TimeoutError also matches
+// ErrNotConnected with errors.Is.
+type TimeoutError struct {
+	// Op is the operation that was abandoned, "send" or "read".
+	Op string
+
+	// Err is context.Canceled or context.DeadlineExceeded.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("CTC %s abandoned: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() []error {
+	return []error{e.Err, ErrNotConnected}
+}
+
+// Timeout reports whether the operation was abandoned because its deadline
+// passed, as opposed to being canceled.
+func (e *TimeoutError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// reconnectDelay is how long we wait between attempts to re-establish a lost
+// connection.
+const reconnectDelay = 2 * time.Second
+
 type ctc struct {
-	raddr              string
-	rIP                net.IP
-	rport              uint16
-	lport              uint16
+	raddr  string
+	rIP    net.IP
+	rport  uint16
+	lport  uint16
+	devnum uint16
+	ver    HerculesVersion
+	bo     binary.ByteOrder
+
+	// mu protects the fields below, which are shared with the background
+	// reconnection goroutine.
+	mu                 sync.Mutex
 	recvsock, sendsock net.Conn
-	seq                uint16
-	devnum             uint16
-	ver                HerculesVersion
-	bo                 binary.ByteOrder
+	listener           net.Listener
+	state              State
+
+	// seq is the sequence number of the next packet we send.
+	seq uint16
+
+	// gen is incremented by Close so that a reconnection goroutine started
+	// before the Close knows to give up.
+	gen int
 }
 
 const ctcHdrLenOld = 12
@@ -150,6 +240,21 @@ func New(lport, rport, devnum uint16, raddr string, version HerculesVersion,
 }
 
 func (c *ctc) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.dropLocked()
+	if c.listener != nil {
+		c.listener.Close()
+		c.listener = nil
+	}
+	c.state = StateDisconnected
+}
+
+// dropLocked closes both sockets and resets the CTC to its initial state. c.mu
+// must be held.
+func (c *ctc) dropLocked() {
 	if c.sendsock != nil {
 		log.Debug().Msg("Closing sendsock")
 		c.sendsock.Close()
@@ -160,17 +265,42 @@ func (c *ctc) Close() {
 		c.recvsock.Close()
 	}
 
-	// Reset the ctc to its initial state
 	c.sendsock = nil
 	c.recvsock = nil
 	c.seq = 1
 }
 
+func (c *ctc) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
 func (c *ctc) Connect() error {
-	if c.sendsock != nil || c.recvsock != nil {
+	c.mu.Lock()
+	if c.state != StateDisconnected {
+		c.mu.Unlock()
 		return ErrAlreadyConnected
 	}
+	c.state = StateConnecting
+	gen := c.gen
+	c.mu.Unlock()
+
+	if err := c.connect(gen); err != nil {
+		c.mu.Lock()
+		if c.gen == gen {
+			c.state = StateDisconnected
+		}
+		c.mu.Unlock()
+		return err
+	}
 
+	return nil
+}
+
+// connect performs one attempt to establish the connection with Hercules.
+// If Close is called while we're waiting, the attempt is abandoned.
+func (c *ctc) connect(gen int) error {
 	// First, we wait for Hercules to connect to us. If the remote side is
 	// Hercules 3.13, we listen on the odd port number and connect to the
 	// odd port.
@@ -190,7 +320,19 @@ func (c *ctc) Connect() error {
 	}
 	defer listener.Close()
 
+	// Make the listener available to Close so it can interrupt Accept.
+	c.mu.Lock()
+	if c.gen != gen {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	c.listener = listener
+	c.mu.Unlock()
+
 	recvsock, err := listener.Accept()
+	c.mu.Lock()
+	c.listener = nil
+	c.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -201,7 +343,8 @@ func (c *ctc) Connect() error {
 
 	log.Info().Msgf("Connecting to remote hercules at %s:%d", c.raddr, rport)
 	if c.ver == HerculesVersionNew {
-		sendsock, err = net.Dial("tcp", fmt.Sprintf("%s:%d", c.raddr, rport))
+		sendsock, err = net.Dial("tcp",
+			net.JoinHostPort(c.raddr, strconv.Itoa(int(rport))))
 		if err != nil {
 			recvsock.Close()
 			return err
@@ -216,7 +359,7 @@ func (c *ctc) Connect() error {
 			return err
 		}
 		sendaddr, err := net.ResolveTCPAddr("tcp",
-			fmt.Sprintf("%s:%d", c.raddr, rport))
+			net.JoinHostPort(c.raddr, strconv.Itoa(int(rport))))
 		if err != nil {
 			recvsock.Close()
 			return err
@@ -228,31 +371,36 @@ func (c *ctc) Connect() error {
 		}
 	}
 
-	c.recvsock = recvsock
-	c.sendsock = sendsock
-
 	if c.ver == HerculesVersionNew {
-		if err := c.handshake(); err != nil {
+		if err := c.handshake(recvsock, sendsock); err != nil {
 			recvsock.Close()
 			sendsock.Close()
-			c.recvsock = nil
-			c.sendsock = nil
-			return fmt.Errorf("handshake error: %v", err)
+			return fmt.Errorf("handshake error: %w", err)
 		}
 		log.Info().Msg("Hercules handshake successful")
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		// We were closed while connecting.
+		recvsock.Close()
+		sendsock.Close()
+		return ErrNotConnected
+	}
 	c.recvsock = recvsock
 	c.sendsock = sendsock
+	c.seq = 1
+	c.state = StateConnected
 
 	return nil
 }
 
-func (c *ctc) handshake() error {
+func (c *ctc) handshake(recvsock, sendsock net.Conn) error {
 	// Expect 16 bytes from Hercules, which we will simply discard.
 	buf := make([]byte, ctcHdrLenNew)
 	for n := 0; n < ctcHdrLenNew; {
-		nn, err := c.recvsock.Read(buf[n:])
+		nn, err := recvsock.Read(buf[n:])
 		if err != nil {
 			return err
 		}
@@ -277,19 +425,133 @@ func (c *ctc) handshake() error {
 	sendbuf.WriteByte(0)                               // padding
 	sendbuf.WriteByte(0)                               // padding
 
-	if _, err := c.sendsock.Write(sendbuf.Bytes()); err != nil {
+	if _, err := sendsock.Write(sendbuf.Bytes()); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (c *ctc) Send(cmd CTCCmd, count uint16, data []byte) error {
+func (c *ctc) Reset() {
+	c.lost(nil, errors.New("reset requested"))
+}
+
+// lost tears down a connection that has failed, and returns the error to
+// hand back to the caller whose operation discovered the failure. conn is the
+// socket the failure happened on; if it's no longer one of the current
+// sockets, the connection it belonged to is already gone and the current one
+// is left alone. A nil conn means the current connection. Spinhawk and
+// Hyperion will keep trying to reconnect to us, so for those we start
+// listening again in the background. Hercules 3.13 has no reconnection
+// logic, so there's no point.
+func (c *ctc) lost(conn net.Conn, cause error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != StateConnected {
+		return fmt.Errorf("%w: %v", ErrNotConnected, cause)
+	}
+	if conn != nil && conn != c.recvsock && conn != c.sendsock {
+		log.Debug().Err(cause).Msgf("CTC %03x: ignoring failure on an old "+
+			"connection", c.devnum)
+		return fmt.Errorf("%w: %v", ErrNotConnected, cause)
+	}
+
+	log.Warn().Err(cause).Msgf("CTC %03x: connection to Hercules lost",
+		c.devnum)
+	c.dropLocked()
+
+	if c.ver != HerculesVersionNew {
+		c.state = StateDisconnected
+		return fmt.Errorf("%w: %v", ErrNotConnected, cause)
+	}
+
+	c.state = StateConnecting
+	go c.reconnect(c.gen)
+
+	return fmt.Errorf("%w: %v", ErrNotConnected, cause)
+}
+
+// reconnect keeps trying to re-establish the connection until it succeeds or
+// the CTC is closed.
+func (c *ctc) reconnect(gen int) {
+	for {
+		err := c.connect(gen)
+
+		c.mu.Lock()
+		closed := c.gen != gen
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		if err == nil {
+			log.Info().Msgf("CTC %03x: reconnected to Hercules", c.devnum)
+			return
+		}
+
+		log.Warn().Err(err).Msgf("CTC %03x: reconnection attempt failed",
+			c.devnum)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// sockets returns the current sockets, or ErrNotConnected if we're not
+// connected.
+func (c *ctc) sockets() (recvsock, sendsock net.Conn, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != StateConnected {
+		return nil, nil, ErrNotConnected
+	}
+	return c.recvsock, c.sendsock, nil
+}
+
+// watch applies ctx's deadline, if any, to conn, and arranges for a blocked
+// read or write on conn to be interrupted if ctx is canceled. The returned
+// function must be called once the I/O is finished.
+func watch(ctx context.Context, conn net.Conn) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stopAfter := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return func() { stopAfter() }
+}
+
+// fail handles an error from a socket read or write on conn by treating the
+// connection as lost. If the I/O failed because ctx ended, the error returned
+// is a *TimeoutError.
+func (c *ctc) fail(ctx context.Context, op string, conn net.Conn,
+	err error) error {
+
+	ctxErr := ctx.Err()
+	if ctxErr == nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		// The socket deadline can fire a moment before the context notices
+		// its own deadline has passed.
+		ctxErr = context.DeadlineExceeded
+	}
+	if ctxErr == nil {
+		return c.lost(conn, err)
+	}
+
+	c.lost(conn, ctxErr)
+	return &TimeoutError{Op: op, Err: ctxErr}
+}
+
+func (c *ctc) Send(ctx context.Context, cmd CTCCmd, count uint16,
+	data []byte) error {
+
 	var buf bytes.Buffer
 
-	if c.sendsock == nil || c.recvsock == nil {
+	c.mu.Lock()
+	if c.state != StateConnected {
+		c.mu.Unlock()
 		return ErrNotConnected
 	}
+	sendsock, seq := c.sendsock, c.seq
+	c.mu.Unlock()
 
 	commandName := "unknown"
 	var fsmState byte
@@ -314,7 +576,7 @@ func (c *ctc) Send(cmd CTCCmd, count uint16, data []byte) error {
 			CmdReg:   cmd,
 			FsmState: fsmState,
 			SCount:   count,
-			PktSeq:   c.seq,
+			PktSeq:   seq,
 			SndLen:   ctcHdrLenOld + uint16(len(data)),
 			DevNum:   c.devnum,
 			SSID:     ssid,
@@ -324,7 +586,7 @@ func (c *ctc) Send(cmd CTCCmd, count uint16, data []byte) error {
 			CmdReg:   cmd,
 			FsmState: fsmState,
 			SCount:   count,
-			PktSeq:   c.seq,
+			PktSeq:   seq,
 			SndLen:   ctcHdrLenNew + uint16(len(data)),
 			DevNum:   c.devnum,
 			SSID:     ssid,
@@ -335,17 +597,26 @@ func (c *ctc) Send(cmd CTCCmd, count uint16, data []byte) error {
 
 	log.Trace().Str("command", commandName).Hex("data", buf.Bytes()).Msg("SEND")
 
-	if _, err := c.sendsock.Write(buf.Bytes()); err != nil {
-		return err
+	stop := watch(ctx, sendsock)
+	_, err := sendsock.Write(buf.Bytes())
+	stop()
+	if err != nil {
+		return c.fail(ctx, "send", sendsock, err)
 	}
 
-	c.seq++
+	c.mu.Lock()
+	if c.sendsock == sendsock {
+		c.seq++
+	}
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *ctc) Read() (cmd CTCCmd, count uint16, data []byte, err error) {
+func (c *ctc) Read(ctx context.Context) (cmd CTCCmd, count uint16,
+	data []byte, err error) {
+
 	for {
-		cmd, count, data, err = c.read()
+		cmd, count, data, err = c.read(ctx)
 		if err != nil {
 			return cmd, count, data, err
 		}
@@ -358,7 +629,17 @@ func (c *ctc) Read() (cmd CTCCmd, count uint16, data []byte, err error) {
 	}
 }
 
-func (c *ctc) read() (cmd CTCCmd, count uint16, data []byte, err error) {
+func (c *ctc) read(ctx context.Context) (cmd CTCCmd, count uint16,
+	data []byte, err error) {
+
+	recvsock, _, err := c.sockets()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	stop := watch(ctx, recvsock)
+	defer stop()
+
 	var buf []byte
 	if c.ver == HerculesVersionOld {
 		buf = make([]byte, ctcHdrLenOld)
@@ -368,9 +649,9 @@ func (c *ctc) read() (cmd CTCCmd, count uint16, data []byte, err error) {
 
 	// Read the header info
 	for n := 0; n < len(buf); {
-		nn, err := c.recvsock.Read(buf[n:])
+		nn, err := recvsock.Read(buf[n:])
 		if err != nil {
-			return 0, 0, nil, err
+			return 0, 0, nil, c.fail(ctx, "read", recvsock, err)
 		}
 		n += nn
 	}
@@ -403,9 +684,9 @@ func (c *ctc) read() (cmd CTCCmd, count uint16, data []byte, err error) {
 	if dataLen > 0 {
 		data = make([]byte, dataLen)
 		for n := 0; n < len(data); {
-			nn, err := c.recvsock.Read(data[n:])
+			nn, err := recvsock.Read(data[n:])
 			if err != nil {
-				return cmd, count, data, err
+				return cmd, count, data, c.fail(ctx, "read", recvsock, err)
 			}
 			n += nn
 		}
@@ -421,17 +702,17 @@ func (c *ctc) read() (cmd CTCCmd, count uint16, data []byte, err error) {
 // ControlWrite will send a CONTROL, wait for the SENSE from the remote side
 // to clear the CONTROL, send the data with WRITE, and wait for the READ from
 // the remote side. Count for the WRITE will be the length of the data.
-func (c *ctc) ControlWrite(data []byte) error {
+func (c *ctc) ControlWrite(ctx context.Context, data []byte) error {
 	log.Debug().Msg("ctc.ControlWrite(): sending CONTROL")
-	if err := c.Send(CTCCmdControl, 1, nil); err != nil {
-		return fmt.Errorf("couldn't send CONTROL: %v", err)
+	if err := c.Send(ctx, CTCCmdControl, 1, nil); err != nil {
+		return fmt.Errorf("couldn't send CONTROL: %w", err)
 	}
 
 	// Expect a SENSE command in response.
 	log.Debug().Msg("ctc.ControlWrite(): awaiting SENSE")
-	cmd, _, _, err := c.Read()
+	cmd, _, _, err := c.Read(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't read while awaiting SENSE: %v", err)
+		return fmt.Errorf("couldn't read while awaiting SENSE: %w", err)
 	}
 	if cmd != CTCCmdSense {
 		return fmt.Errorf("expected SENSE but got %02x", cmd)
@@ -443,15 +724,15 @@ func (c *ctc) ControlWrite(data []byte) error {
 	// then either Hercules or MVS never picks up the write state change.
 	time.Sleep(10 * time.Millisecond)
 	log.Debug().Msg("ctc.ControlWrite: sending WRITE")
-	if err := c.Send(CTCCmdWrite, uint16(len(data)), data); err != nil {
-		return fmt.Errorf("couldn't send WRITE: %v", err)
+	if err := c.Send(ctx, CTCCmdWrite, uint16(len(data)), data); err != nil {
+		return fmt.Errorf("couldn't send WRITE: %w", err)
 	}
 
 	// Expect the corresponding READ command from the other side
 	log.Debug().Msg("ctc.ControlWrite(): awaiting READ")
-	cmd, _, _, err = c.Read()
+	cmd, _, _, err = c.Read(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't read while awaiting READ: %v", err)
+		return fmt.Errorf("couldn't read while awaiting READ: %w", err)
 	}
 	if cmd != CTCCmdRead {
 		return fmt.Errorf("expected READ, but got %02x", cmd)
@@ -462,18 +743,18 @@ func (c *ctc) ControlWrite(data []byte) error {
 
 // NakedWrite will send the data with WRITE, and wait for the READ from
 // the remote side. Count for the WRITE will be the length of the data.
-func (c *ctc) NakedWrite(data []byte) error {
+func (c *ctc) NakedWrite(ctx context.Context, data []byte) error {
 
 	log.Debug().Msg("ctc.NakedWrite: sending WRITE")
-	if err := c.Send(CTCCmdWrite, uint16(len(data)), data); err != nil {
-		return fmt.Errorf("couldn't send WRITE: %v", err)
+	if err := c.Send(ctx, CTCCmdWrite, uint16(len(data)), data); err != nil {
+		return fmt.Errorf("couldn't send WRITE: %w", err)
 	}
 
 	// Expect the corresponding READ command from the other side
 	log.Debug().Msg("ctc.ConNakedWritetrolWrite(): awaiting READ")
-	cmd, _, _, err := c.Read()
+	cmd, _, _, err := c.Read(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't read while awaiting READ: %v", err)
+		return fmt.Errorf("couldn't read while awaiting READ: %w", err)
 	}
 	if cmd != CTCCmdRead {
 		return fmt.Errorf("expected READ, but got %02x", cmd)
@@ -484,11 +765,11 @@ func (c *ctc) NakedWrite(data []byte) error {
 
 // SenseWait will await a SENSE, send a CONTROL in response, then perform a
 // READ, returning the bytes that were read.
-func (c *ctc) SenseRead() ([]byte, error) {
+func (c *ctc) SenseRead(ctx context.Context) ([]byte, error) {
 	log.Debug().Msg("ctc.SenseRead(): awaiting CONTROL")
-	cmd, _, _, err := c.Read()
+	cmd, _, _, err := c.Read(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't read while awaiting CONTROL: %v", err)
+		return nil, fmt.Errorf("couldn't read while awaiting CONTROL: %w", err)
 	}
 	if cmd != CTCCmdControl {
 		return nil, fmt.Errorf("expected CONTROL, but got %02x", cmd)
@@ -496,15 +777,15 @@ func (c *ctc) SenseRead() ([]byte, error) {
 
 	// Send a SENSE command in response
 	log.Debug().Msg("ctc.SenseRead(): sending SENSE")
-	if err := c.Send(CTCCmdSense, 1, nil); err != nil {
-		return nil, fmt.Errorf("couldn't send SENSE: %v", err)
+	if err := c.Send(ctx, CTCCmdSense, 1, nil); err != nil {
+		return nil, fmt.Errorf("couldn't send SENSE: %w", err)
 	}
 
 	// Read the data
 	log.Debug().Msg("ctc.SenseRead(): reading data")
-	cmd, count, data, err := c.Read()
+	cmd, count, data, err := c.Read(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't read data: %v", err)
+		return nil, fmt.Errorf("couldn't read data: %w", err)
 	}
 	log.Debug().
 		Hex("command", []byte{byte(cmd)}).
@@ -515,8 +796,9 @@ func (c *ctc) SenseRead() ([]byte, error) {
 		return data, fmt.Errorf("expected WRITE, but got %02x", cmd)
 	}
 	// Now send our READ command to indicate we've read the response
-	if err := c.Send(CTCCmdRead, count, nil); err != nil {
-		return data, fmt.Errorf("couldn't send READ in respone to WRITE")
+	if err := c.Send(ctx, CTCCmdRead, count, nil); err != nil {
+		return data, fmt.Errorf("couldn't send READ in response to WRITE: %w",
+			err)
 	}
 
 	return data, nil
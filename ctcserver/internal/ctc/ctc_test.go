@@ -0,0 +1,233 @@
+package ctc_test
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc/ctctest"
+)
+
+const testDevnum = 0x500
+
+// variants are the Hercules versions and byte orders every test runs with.
+var variants = []struct {
+	name string
+	ver  ctc.HerculesVersion
+	bo   binary.ByteOrder
+}{
+	{"3.13/little", ctc.HerculesVersionOld, binary.LittleEndian},
+	{"3.13/big", ctc.HerculesVersionOld, binary.BigEndian},
+	{"hyperion/little", ctc.HerculesVersionNew, binary.LittleEndian},
+	{"hyperion/big", ctc.HerculesVersionNew, binary.BigEndian},
+}
+
+// payloads are the data sent in each direction.
+var payloads = [][]byte{
+	{},
+	{0xFF},
+	bytes.Repeat([]byte{0x40}, 80),
+	bytes.Repeat([]byte{0x00, 0xC1, 0xF0, 0xFF}, 1024),
+}
+
+// newPair connects a ctc.CTC to a fake Hercules peer over loopback, closing
+// both when the test ends.
+func newPair(t *testing.T, ver ctc.HerculesVersion,
+	bo binary.ByteOrder) (ctc.CTC, *ctctest.Peer) {
+
+	t.Helper()
+	local, peer, err := ctctest.NewPair(testDevnum, ver, bo)
+	if err != nil {
+		t.Fatalf("couldn't connect pair: %v", err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+	return local, peer
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// peerSide runs fn, the peer's half of an exchange, in the background. The
+// returned function waits for it and returns its result.
+func peerSide(fn func() ([]byte, error)) func() ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := fn()
+		done <- result{data, err}
+	}()
+	return func() ([]byte, error) {
+		r := <-done
+		return r.data, r.err
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+
+			if state := local.State(); state != ctc.StateConnected {
+				t.Errorf("ctc state is %v, want connected", state)
+			}
+			if state := peer.State(); state != ctc.StateConnected {
+				t.Errorf("peer state is %v, want connected", state)
+			}
+
+			if v.ver == ctc.HerculesVersionNew {
+				if peer.Init.DevNum != testDevnum {
+					t.Errorf("handshake device number is %04x, want %04x",
+						peer.Init.DevNum, testDevnum)
+				}
+				if peer.Init.SSID != 1 {
+					t.Errorf("handshake SSID is %d, want 1", peer.Init.SSID)
+				}
+			}
+		})
+	}
+}
+
+func TestControlWrite(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+			ctx := testContext(t)
+
+			for _, want := range payloads {
+				wait := peerSide(func() ([]byte, error) {
+					return peer.SenseRead(ctx)
+				})
+				if err := local.ControlWrite(ctx, want); err != nil {
+					t.Fatalf("ControlWrite: %v", err)
+				}
+				got, err := wait()
+				if err != nil {
+					t.Fatalf("peer SenseRead: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("peer received %x, want %x", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSenseRead(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+			ctx := testContext(t)
+
+			for _, want := range payloads {
+				wait := peerSide(func() ([]byte, error) {
+					return nil, peer.ControlWrite(ctx, want)
+				})
+				got, err := local.SenseRead(ctx)
+				if err != nil {
+					t.Fatalf("SenseRead: %v", err)
+				}
+				if _, err := wait(); err != nil {
+					t.Fatalf("peer ControlWrite: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("received %x, want %x", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNakedWrite(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+			ctx := testContext(t)
+
+			for _, want := range payloads {
+				wait := peerSide(func() ([]byte, error) {
+					return peer.ReadWrite(ctx)
+				})
+				if err := local.NakedWrite(ctx, want); err != nil {
+					t.Fatalf("NakedWrite: %v", err)
+				}
+				got, err := wait()
+				if err != nil {
+					t.Fatalf("peer ReadWrite: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("peer received %x, want %x", got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestTestIOIgnored checks that the test I/O packets Hercules sends between
+// CCWs are skipped.
+func TestTestIOIgnored(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+			ctx := testContext(t)
+			want := []byte{0xC8, 0xC5, 0xD3, 0xD3, 0xD6}
+
+			wait := peerSide(func() ([]byte, error) {
+				if err := peer.SendTestIO(ctx); err != nil {
+					return nil, err
+				}
+				return nil, peer.ControlWrite(ctx, want)
+			})
+			got, err := local.SenseRead(ctx)
+			if err != nil {
+				t.Fatalf("SenseRead: %v", err)
+			}
+			if _, err := wait(); err != nil {
+				t.Fatalf("peer: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("received %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// TestUnexpectedCommand checks that SenseRead reports a protocol error when
+// the other side sends something other than a CONTROL.
+func TestUnexpectedCommand(t *testing.T) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			local, peer := newPair(t, v.ver, v.bo)
+			ctx := testContext(t)
+
+			if err := peer.Send(ctx, ctc.CTCCmdWrite, 1,
+				[]byte{0x01}); err != nil {
+
+				t.Fatalf("peer Send: %v", err)
+			}
+			if _, err := local.SenseRead(ctx); err == nil {
+				t.Error("SenseRead succeeded after a WRITE without CONTROL")
+			}
+		})
+	}
+}
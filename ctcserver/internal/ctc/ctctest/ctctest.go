@@ -0,0 +1,544 @@
+// Package ctctest provides a fake Hercules CTCE device for exercising the ctc
+// package without a running Hercules and MVS system.
+//
+// A Peer plays the Hercules side of one emulated CTC adapter: it accepts the
+// connection from a ctc.CTC, connects back to it, performs the handshake
+// Spinhawk and Hyperion expect, and then exchanges CCW packets using the same
+// wire format Hercules does. Since the CTC protocol is symmetric, Peer
+// implements ctc.CTC itself; calling SenseRead on a Peer receives the data a
+// ctc.CTC sends with ControlWrite, and vice versa.
+package ctctest
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// ConnectTimeout is how long Connect will keep retrying the connection to the
+// ctc.CTC listener before giving up.
+var ConnectTimeout = 5 * time.Second
+
+// ErrUnexpectedCommand is wrapped by the errors returned from the CCW-level
+// operations when the other side sent a different command than the protocol
+// calls for.
+var ErrUnexpectedCommand = errors.New("unexpected CTC command")
+
+const (
+	hdrLenOld = 12
+	hdrLenNew = 16
+
+	// hercInfo is the first halfword of the handshake message a ctc.CTC
+	// sends to Spinhawk and Hyperion.
+	hercInfo uint16 = 0x8010
+)
+
+// Header layouts must stay in sync with ctcHdrOld and ctcHdrNew in the ctc
+// package; we keep our own copy so the fake is an independent check of the
+// wire format rather than a reuse of it.
+
+type hdrOld struct {
+	CmdReg   ctc.CTCCmd
+	FsmState byte
+	SCount   uint16
+	PktSeq   uint16
+	SndLen   uint16
+	DevNum   uint16
+	SSID     uint16
+}
+
+type hdrNew struct {
+	CmdReg   ctc.CTCCmd
+	FsmState byte
+	SCount   uint16
+	PktSeq   uint16
+	_        uint16
+	SndLen   uint16
+	DevNum   uint16
+	SSID     uint16
+	_        uint16
+}
+
+// InitMsg is the handshake message a ctc.CTC sends to Spinhawk and Hyperion
+// after connecting. It is only populated for HerculesVersionNew.
+type InitMsg struct {
+	HercInfo  uint16
+	LocalPort uint16
+	RemoteIP  net.IP
+	SndLen    uint16
+	DevNum    uint16
+	SSID      uint16
+}
+
+// Peer is the Hercules side of a single emulated CTCE device.
+type Peer struct {
+	raddr              string
+	lport              uint16
+	rport              uint16
+	devnum             uint16
+	ver                ctc.HerculesVersion
+	bo                 binary.ByteOrder
+	listener           net.Listener
+	recvsock, sendsock net.Conn
+	seq                uint16
+
+	// Init is the handshake message received from the ctc.CTC during
+	// Connect when emulating Spinhawk or Hyperion.
+	Init InitMsg
+
+	mu     sync.Mutex
+	closed bool
+}
+
+var _ ctc.CTC = (*Peer)(nil)
+
+// New creates a fake Hercules CTCE device and immediately begins listening
+// for the ctc.CTC to connect to it. The parameters mirror a Hercules device
+// statement such as "0502 CTCE lport raddr rport": lport is the port Hercules
+// listens on (the ctc package's rport) and rport is the port Hercules connects
+// to (the ctc package's lport). As with Hercules 3.13, when version is
+// HerculesVersionOld both ports must be even and the odd port above each is
+// the one actually used.
+func New(lport, rport, devnum uint16, raddr string,
+	version ctc.HerculesVersion, byteOrder binary.ByteOrder) (*Peer, error) {
+
+	if !(version == ctc.HerculesVersionOld ||
+		version == ctc.HerculesVersionNew) {
+		return nil, ctc.ErrInvalidVersion
+	}
+
+	p := &Peer{
+		raddr:  raddr,
+		lport:  lport,
+		rport:  rport,
+		devnum: devnum,
+		ver:    version,
+		bo:     byteOrder,
+		seq:    1,
+	}
+
+	listenPort := lport
+	if version == ctc.HerculesVersionOld {
+		listenPort++
+	}
+
+	listener, err := net.Listen("tcp",
+		net.JoinHostPort(raddr, strconv.Itoa(int(listenPort))))
+	if err != nil {
+		return nil, err
+	}
+	p.listener = listener
+
+	return p, nil
+}
+
+// Close shuts down the listener and both sockets. It is safe to call Close
+// more than once, and from a different goroutine than one blocked in Read.
+func (p *Peer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.sendsock != nil {
+		p.sendsock.Close()
+	}
+	if p.recvsock != nil {
+		p.recvsock.Close()
+	}
+}
+
+// Reset drops both connections without closing the listener, as Hercules
+// does when the device is detached. Call Connect again to simulate the
+// device being re-attached.
+func (p *Peer) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sendsock != nil {
+		p.sendsock.Close()
+	}
+	if p.recvsock != nil {
+		p.recvsock.Close()
+	}
+	p.sendsock = nil
+	p.recvsock = nil
+	p.seq = 1
+}
+
+// State reports whether the Peer is currently connected.
+func (p *Peer) State() ctc.State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.sendsock == nil || p.recvsock == nil {
+		return ctc.StateDisconnected
+	}
+	return ctc.StateConnected
+}
+
+// sockets returns the current sockets, or ctc.ErrNotConnected if the Peer
+// isn't connected.
+func (p *Peer) sockets() (recvsock, sendsock net.Conn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sendsock == nil || p.recvsock == nil {
+		return nil, nil, ctc.ErrNotConnected
+	}
+	return p.recvsock, p.sendsock, nil
+}
+
+// Connect establishes both halves of the connection with a ctc.CTC whose
+// Connect method is running concurrently. Like Spinhawk and Hyperion, the
+// outbound connection is retried until it succeeds or ConnectTimeout expires.
+func (p *Peer) Connect() error {
+	if p.State() == ctc.StateConnected {
+		return ctc.ErrAlreadyConnected
+	}
+
+	dialPort := p.rport
+	if p.ver == ctc.HerculesVersionOld {
+		dialPort++
+	}
+	daddr := net.JoinHostPort(p.raddr, strconv.Itoa(int(dialPort)))
+
+	var sendsock net.Conn
+	var err error
+	deadline := time.Now().Add(ConnectTimeout)
+	for {
+		sendsock, err = net.Dial("tcp", daddr)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("couldn't connect to %s: %v", daddr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p.ver == ctc.HerculesVersionNew {
+		// Spinhawk and Hyperion send 16 bytes of their own device
+		// information first; ctc.CTC discards it, so any content will do as
+		// long as it is the right length.
+		if err := p.sendHello(sendsock); err != nil {
+			sendsock.Close()
+			return fmt.Errorf("couldn't send handshake: %v", err)
+		}
+	}
+
+	p.listener.(*net.TCPListener).SetDeadline(deadline)
+	recvsock, err := p.listener.Accept()
+	if err != nil {
+		sendsock.Close()
+		return err
+	}
+
+	if p.ver == ctc.HerculesVersionOld {
+		// Hercules 3.13 identifies its peer by the source port of the
+		// inbound connection, which must match its configured rport.
+		_, port, _ := net.SplitHostPort(recvsock.RemoteAddr().String())
+		if port != strconv.Itoa(int(p.rport)) {
+			sendsock.Close()
+			recvsock.Close()
+			return fmt.Errorf("inbound connection from source port %s, "+
+				"but Hercules 3.13 requires source port %d", port, p.rport)
+		}
+	}
+
+	p.mu.Lock()
+	p.sendsock = sendsock
+	p.recvsock = recvsock
+	p.seq = 1
+	p.mu.Unlock()
+
+	if p.ver == ctc.HerculesVersionNew {
+		recvsock.SetReadDeadline(deadline)
+		err := p.readInit(recvsock)
+		recvsock.SetReadDeadline(time.Time{})
+		if err != nil {
+			p.Close()
+			return fmt.Errorf("handshake error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Peer) sendHello(conn net.Conn) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, p.bo, hercInfo)
+	binary.Write(&buf, p.bo, p.lport)
+	buf.Write(net.IPv4(127, 0, 0, 1).To4())
+	binary.Write(&buf, p.bo, uint16(hdrLenNew))
+	binary.Write(&buf, p.bo, p.devnum)
+	binary.Write(&buf, p.bo, uint16(1))
+	buf.Write([]byte{0, 0})
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+func (p *Peer) readInit(recvsock net.Conn) error {
+	buf := make([]byte, hdrLenNew)
+	if err := readFull(recvsock, buf); err != nil {
+		return err
+	}
+
+	p.Init = InitMsg{
+		HercInfo:  p.bo.Uint16(buf[0:2]),
+		LocalPort: p.bo.Uint16(buf[2:4]),
+		RemoteIP:  net.IP(append([]byte(nil), buf[4:8]...)),
+		SndLen:    p.bo.Uint16(buf[8:10]),
+		DevNum:    p.bo.Uint16(buf[10:12]),
+		SSID:      p.bo.Uint16(buf[12:14]),
+	}
+
+	if p.Init.HercInfo != hercInfo {
+		return fmt.Errorf("expected hercules info %04x but got %04x",
+			hercInfo, p.Init.HercInfo)
+	}
+	if p.Init.SndLen != hdrLenNew {
+		return fmt.Errorf("expected send length %d but got %d",
+			hdrLenNew, p.Init.SndLen)
+	}
+	if p.Init.LocalPort != p.rport {
+		return fmt.Errorf("peer reports listening on port %d but we "+
+			"connected to %d", p.Init.LocalPort, p.rport)
+	}
+
+	return nil
+}
+
+// watch applies ctx's deadline, if any, to conn, and interrupts any blocked
+// read or write on conn if ctx is canceled. Call the returned function once
+// the I/O is finished.
+func watch(ctx context.Context, conn net.Conn) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stopAfter := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return func() { stopAfter() }
+}
+
+// ctxErr returns ctx's error in place of err if the I/O failed because ctx
+// ended.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func readFull(conn net.Conn, buf []byte) error {
+	for n := 0; n < len(buf); {
+		nn, err := conn.Read(buf[n:])
+		if err != nil {
+			return err
+		}
+		n += nn
+	}
+	return nil
+}
+
+// Send sends a single CTCE packet carrying the CCW command cmd, just as
+// Hercules does when the channel program on the MVS side executes a CCW.
+func (p *Peer) Send(ctx context.Context, cmd ctc.CTCCmd, count uint16,
+	data []byte) error {
+
+	_, sendsock, err := p.sockets()
+	if err != nil {
+		return err
+	}
+
+	var fsmState byte
+	switch cmd {
+	case ctc.CTCCmdControl:
+		fsmState = 0x01
+	case ctc.CTCCmdRead, ctc.CTCCmdSense:
+		fsmState = 0x04
+	case ctc.CTCCmdWrite:
+		fsmState = 0x03
+	}
+
+	var buf bytes.Buffer
+	if p.ver == ctc.HerculesVersionOld {
+		binary.Write(&buf, p.bo, hdrOld{
+			CmdReg:   cmd,
+			FsmState: fsmState,
+			SCount:   count,
+			PktSeq:   p.seq,
+			SndLen:   hdrLenOld + uint16(len(data)),
+			DevNum:   p.devnum,
+			SSID:     1,
+		})
+	} else {
+		binary.Write(&buf, p.bo, hdrNew{
+			CmdReg:   cmd,
+			FsmState: fsmState,
+			SCount:   count,
+			PktSeq:   p.seq,
+			SndLen:   hdrLenNew + uint16(len(data)),
+			DevNum:   p.devnum,
+			SSID:     1,
+		})
+	}
+	buf.Write(data)
+
+	stop := watch(ctx, sendsock)
+	defer stop()
+	if _, err := sendsock.Write(buf.Bytes()); err != nil {
+		return ctxErr(ctx, err)
+	}
+
+	p.seq++
+	return nil
+}
+
+// SendTestIO sends a test I/O packet, which ctc.CTC is expected to ignore.
+func (p *Peer) SendTestIO(ctx context.Context) error {
+	return p.Send(ctx, ctc.CTCCmdTest, 0, nil)
+}
+
+// Read returns the next packet received from the ctc.CTC. Unlike
+// ctc.CTC.Read, test I/O packets are not skipped.
+func (p *Peer) Read(ctx context.Context) (cmd ctc.CTCCmd, count uint16,
+	data []byte, err error) {
+
+	recvsock, _, err := p.sockets()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	stop := watch(ctx, recvsock)
+	defer stop()
+
+	hdrLen := hdrLenOld
+	if p.ver == ctc.HerculesVersionNew {
+		hdrLen = hdrLenNew
+	}
+	buf := make([]byte, hdrLen)
+	if err := readFull(recvsock, buf); err != nil {
+		return 0, 0, nil, ctxErr(ctx, err)
+	}
+
+	var sndLen, devnum uint16
+	if p.ver == ctc.HerculesVersionOld {
+		var header hdrOld
+		binary.Read(bytes.NewReader(buf), p.bo, &header)
+		cmd, count, sndLen, devnum =
+			header.CmdReg, header.SCount, header.SndLen, header.DevNum
+	} else {
+		var header hdrNew
+		binary.Read(bytes.NewReader(buf), p.bo, &header)
+		cmd, count, sndLen, devnum =
+			header.CmdReg, header.SCount, header.SndLen, header.DevNum
+	}
+
+	if int(sndLen) < hdrLen {
+		return cmd, count, nil, fmt.Errorf(
+			"packet send length %d is shorter than the %d byte header",
+			sndLen, hdrLen)
+	}
+	if p.ver == ctc.HerculesVersionNew && devnum != p.Init.DevNum {
+		return cmd, count, nil, fmt.Errorf(
+			"packet device number %04x does not match handshake %04x",
+			devnum, p.Init.DevNum)
+	}
+
+	data = make([]byte, int(sndLen)-hdrLen)
+	if err := readFull(recvsock, data); err != nil {
+		return cmd, count, data, ctxErr(ctx, err)
+	}
+
+	return cmd, count, data, nil
+}
+
+func (p *Peer) expect(ctx context.Context, want ctc.CTCCmd) (uint16, []byte,
+	error) {
+
+	cmd, count, data, err := p.Read(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if cmd != want {
+		return count, data, fmt.Errorf("%w: expected %02x but got %02x",
+			ErrUnexpectedCommand, want, cmd)
+	}
+	return count, data, nil
+}
+
+// ControlWrite sends a CONTROL, waits for the ctc.CTC to SENSE it, then
+// sends the data with WRITE and waits for the matching READ. It is the
+// counterpart of ctc.CTC.SenseRead.
+func (p *Peer) ControlWrite(ctx context.Context, data []byte) error {
+	if err := p.Send(ctx, ctc.CTCCmdControl, 1, nil); err != nil {
+		return fmt.Errorf("couldn't send CONTROL: %v", err)
+	}
+	if _, _, err := p.expect(ctx, ctc.CTCCmdSense); err != nil {
+		return fmt.Errorf("awaiting SENSE: %w", err)
+	}
+	return p.NakedWrite(ctx, data)
+}
+
+// NakedWrite sends the data with WRITE and waits for the matching READ,
+// without first sending a CONTROL.
+func (p *Peer) NakedWrite(ctx context.Context, data []byte) error {
+	if err := p.Send(ctx, ctc.CTCCmdWrite, uint16(len(data)), data); err != nil {
+		return fmt.Errorf("couldn't send WRITE: %v", err)
+	}
+	if _, _, err := p.expect(ctx, ctc.CTCCmdRead); err != nil {
+		return fmt.Errorf("awaiting READ: %w", err)
+	}
+	return nil
+}
+
+// SenseRead waits for a CONTROL, clears it with a SENSE, then reads the data
+// from the following WRITE and acknowledges it with a READ. It is the
+// counterpart of ctc.CTC.ControlWrite.
+func (p *Peer) SenseRead(ctx context.Context) ([]byte, error) {
+	if _, _, err := p.expect(ctx, ctc.CTCCmdControl); err != nil {
+		return nil, fmt.Errorf("awaiting CONTROL: %w", err)
+	}
+	if err := p.Send(ctx, ctc.CTCCmdSense, 1, nil); err != nil {
+		return nil, fmt.Errorf("couldn't send SENSE: %v", err)
+	}
+	return p.ReadWrite(ctx)
+}
+
+// ReadWrite waits for a WRITE without a preceding CONTROL and acknowledges
+// it with a READ. This is what a bare READ CCW on the MVS side looks like,
+// and is the counterpart of ctc.CTC.NakedWrite.
+func (p *Peer) ReadWrite(ctx context.Context) ([]byte, error) {
+	count, data, err := p.expect(ctx, ctc.CTCCmdWrite)
+	if err != nil {
+		return data, fmt.Errorf("awaiting WRITE: %w", err)
+	}
+	if err := p.Send(ctx, ctc.CTCCmdRead, count, nil); err != nil {
+		return data, fmt.Errorf("couldn't send READ: %v", err)
+	}
+	return data, nil
+}
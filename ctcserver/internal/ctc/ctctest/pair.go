@@ -0,0 +1,102 @@
+package ctctest
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+const loopback = "127.0.0.1"
+
+// NewPair creates a ctc.CTC and a Peer on loopback ports chosen by the
+// operating system and connects them to each other. The caller is
+// responsible for closing both.
+func NewPair(devnum uint16, version ctc.HerculesVersion,
+	byteOrder binary.ByteOrder) (ctc.CTC, *Peer, error) {
+
+	ctcPort, err := freePort()
+	if err != nil {
+		return nil, nil, err
+	}
+	peerPort, err := freePort()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peer, err := New(peerPort, ctcPort, devnum, loopback, version, byteOrder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local, err := ctc.New(ctcPort, peerPort, devnum, loopback, version,
+		byteOrder)
+	if err != nil {
+		peer.Close()
+		return nil, nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- peer.Connect()
+	}()
+
+	if err := local.Connect(); err != nil {
+		peer.Close()
+		<-errs
+		return nil, nil, fmt.Errorf("ctc connect: %v", err)
+	}
+	if err := <-errs; err != nil {
+		local.Close()
+		peer.Close()
+		return nil, nil, fmt.Errorf("peer connect: %v", err)
+	}
+
+	return local, peer, nil
+}
+
+// freePort finds an even-numbered loopback port where both it and the odd
+// port above it are currently unused, which satisfies the port numbering
+// rules for every Hercules version.
+func freePort() (uint16, error) {
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(loopback, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		port &^= 1
+		if port == 0 || port+1 > 0xFFFF {
+			continue
+		}
+		if portsAvailable(port, port+1) {
+			return uint16(port), nil
+		}
+	}
+	return 0, fmt.Errorf("couldn't find a free pair of ports")
+}
+
+func portsAvailable(ports ...int) bool {
+	for _, port := range ports {
+		l, err := net.Listen("tcp",
+			net.JoinHostPort(loopback, strconv.Itoa(port)))
+		if err != nil {
+			return false
+		}
+		l.Close()
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package ctc
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestLostStaleConn checks that a failure reported on a socket that has
+// already been replaced by a reconnection leaves the new connection alone.
+func TestLostStaleConn(t *testing.T) {
+	oldConn, oldPeer := net.Pipe()
+	defer oldPeer.Close()
+	oldConn.Close()
+
+	recvsock, recvPeer := net.Pipe()
+	defer recvsock.Close()
+	defer recvPeer.Close()
+	sendsock, sendPeer := net.Pipe()
+	defer sendsock.Close()
+	defer sendPeer.Close()
+
+	c := &ctc{
+		ver:      HerculesVersionOld,
+		recvsock: recvsock,
+		sendsock: sendsock,
+		state:    StateConnected,
+		seq:      7,
+	}
+
+	err := c.lost(oldConn, errors.New("use of closed network connection"))
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("lost returned %v, want ErrNotConnected", err)
+	}
+	if c.State() != StateConnected {
+		t.Fatalf("state is %v after a stale failure, want connected",
+			c.State())
+	}
+	if c.recvsock != recvsock || c.sendsock != sendsock || c.seq != 7 {
+		t.Error("current connection was changed by a stale failure")
+	}
+
+	c.lost(sendsock, errors.New("connection reset"))
+	if c.State() != StateDisconnected {
+		t.Errorf("state is %v after the current connection failed, want "+
+			"disconnected", c.State())
+	}
+	if c.recvsock != nil || c.sendsock != nil || c.seq != 1 {
+		t.Error("current connection wasn't dropped when it failed")
+	}
+}
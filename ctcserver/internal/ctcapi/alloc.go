@@ -0,0 +1,339 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Allocation describes the attributes of a new dataset for Allocate.
+type Allocation struct {
+	// DSOrg is PS or PO.
+	DSOrg string `json:"dsorg"`
+
+	// RecFM is F, V or U, optionally followed by B (blocked) and S (standard
+	// for F, spanned for V), and A or M for carriage control characters. U
+	// can only be followed by A or M.
+	RecFM string `json:"recfm"`
+
+	// LRecLen is the record length, which may be 0 for RECFM=U. BlockSize
+	// is required, and is also used as the average block length when
+	// SpaceUnits is BLK.
+	LRecLen   int `json:"lrecl"`
+	BlockSize int `json:"blksize"`
+
+	// SpaceUnits is CYL, TRK or BLK, and Primary and Secondary are the
+	// quantities to allocate in those units. Secondary may be 0.
+	SpaceUnits string `json:"space_units"`
+	Primary    int    `json:"primary"`
+	Secondary  int    `json:"secondary"`
+
+	// DirectoryBlocks is required for PO datasets, and must be 0 for PS.
+	DirectoryBlocks int `json:"directory_blocks"`
+
+	// Volume and Unit are optional; without them, MVS picks a volume from
+	// the storage volumes of its default unit.
+	Volume string `json:"volume"`
+	Unit   string `json:"unit"`
+}
+
+// maxBlockSize is the largest block size supported on DASD.
+const maxBlockSize = 32760
+
+// maxQuantity is the largest space quantity that fits in a text unit.
+const maxQuantity = 0xFFFFFF
+
+// DCB RECFM bits, as in DS1RECFM.
+const (
+	recfmF = 0x80
+	recfmV = 0x40
+	recfmU = 0xC0
+	recfmB = 0x10
+	recfmS = 0x08
+	recfmA = 0x04
+	recfmM = 0x02
+)
+
+var volserRegex = regexp.MustCompile(`^[A-Z0-9$#@]{1,6}$`)
+
+var unitRegex = regexp.MustCompile(`^[A-Z0-9$#@/-]{1,8}$`)
+
+// Allocate creates and catalogs a new dataset named dsn and returns its
+// description as it would be listed by GetDSList. If the dataset is already
+// cataloged, the error is a *ResultError for which Exists is true.
+func (c *ctcapi) Allocate(ctx context.Context, dsn string,
+	alloc Allocation) (*DSInfo, error) {
+
+	param, err := allocParam(dsn, alloc)
+	if err != nil {
+		log.Debug().Err(err).Msg("invalid allocation in Allocate")
+		return nil, err
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Hex("param", param).Msgf("allocating '%s'", dsn)
+
+	if err := p.sendCommand(ctx, opAllocate, param); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in Allocate()")
+		return nil, err
+	}
+
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Allocate(): couldn't perform SenseRead(): %w",
+			err)
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf(
+			"Allocate(): got %d bytes in initial response but expected 8",
+			len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("Allocate(): unsuccessful result code: %02x/%02x",
+			resultCode, additionalCode)
+		return nil, &ResultError{Op: "ALLOC", Code: resultCode,
+			Additional: additionalCode}
+	}
+
+	data, err = p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Allocate(): couldn't read dataset entry: %w",
+			err)
+	}
+	if len(data) != 147 {
+		return nil, fmt.Errorf(
+			"Allocate(): got length %d dataset entry, but expected 147",
+			len(data))
+	}
+
+	dsinfo := decodeDSInfo(data)
+	return &dsinfo, nil
+}
+
+// allocParam validates the allocation and builds the 77-byte parameter of
+// the ALLOC command.
+func allocParam(dsn string, alloc Allocation) ([]byte, error) {
+	if err := checkDSName(dsn); err != nil {
+		return nil, err
+	}
+	dsn = strings.ToUpper(dsn)
+
+	var dsorg uint16
+	switch strings.ToUpper(alloc.DSOrg) {
+	case "PS":
+		dsorg = 0x4000
+		if alloc.DirectoryBlocks != 0 {
+			return nil, invalidInput(
+				"directory blocks can only be given for DSORG=PO")
+		}
+	case "PO":
+		dsorg = 0x0200
+		if alloc.DirectoryBlocks < 1 {
+			return nil, invalidInput("DSORG=PO needs directory blocks")
+		}
+	default:
+		return nil, invalidInput("DSORG must be PS or PO")
+	}
+
+	recfm, err := parseRecFM(strings.ToUpper(alloc.RecFM))
+	if err != nil {
+		return nil, err
+	}
+	err = checkBlocking(recfm, alloc.LRecLen, alloc.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var units byte
+	switch strings.ToUpper(alloc.SpaceUnits) {
+	case "CYL":
+		units = 0xC0
+	case "TRK":
+		units = 0x80
+	case "BLK":
+		units = 0x40
+	default:
+		return nil, invalidInput("space units must be CYL, TRK or BLK")
+	}
+	if alloc.Primary < 1 || alloc.Primary > maxQuantity {
+		return nil, invalidInput("primary quantity must be between 1 and %d",
+			maxQuantity)
+	}
+	if alloc.Secondary < 0 || alloc.Secondary > maxQuantity {
+		return nil, invalidInput(
+			"secondary quantity must be between 0 and %d", maxQuantity)
+	}
+	if alloc.DirectoryBlocks < 0 || alloc.DirectoryBlocks > maxQuantity {
+		return nil, invalidInput(
+			"directory blocks must be between 0 and %d", maxQuantity)
+	}
+
+	volume := strings.ToUpper(alloc.Volume)
+	if volume != "" && !volserRegex.MatchString(volume) {
+		return nil, invalidInput("volume serial is invalid")
+	}
+	unit := strings.ToUpper(alloc.Unit)
+	if unit != "" && !unitRegex.MatchString(unit) {
+		return nil, invalidInput("unit name is invalid")
+	}
+
+	param := make([]byte, 0, 77)
+	param = append(param, padEbcdic(dsn, 44)...)
+	param = append(param, padEbcdic(volume, 6)...)
+	param = append(param, padEbcdic(unit, 8)...)
+	param = append(param, byte(len(unit)), units)
+	param = binary.BigEndian.AppendUint16(param, dsorg)
+	param = append(param, recfm, 0)
+	param = binary.BigEndian.AppendUint16(param, uint16(alloc.LRecLen))
+	param = binary.BigEndian.AppendUint16(param, uint16(alloc.BlockSize))
+	param = appendQuantity(param, alloc.Primary)
+	param = appendQuantity(param, alloc.Secondary)
+	param = appendQuantity(param, alloc.DirectoryBlocks)
+	return param, nil
+}
+
+// parseRecFM converts a record format such as FB or VBA to its DCB RECFM
+// bits.
+func parseRecFM(s string) (byte, error) {
+	if s == "" {
+		return 0, invalidInput("RECFM is required")
+	}
+
+	var recfm byte
+	allowed := "BSAM"
+	switch s[0] {
+	case 'F':
+		recfm = recfmF
+	case 'V':
+		recfm = recfmV
+	case 'U':
+		recfm = recfmU
+		allowed = "AM"
+	default:
+		return 0, invalidInput("RECFM must begin with F, V or U")
+	}
+
+	// The letters after the first may come in any order, but each only
+	// once, and A and M are mutually exclusive.
+	for _, ch := range s[1:] {
+		var bit byte
+		switch ch {
+		case 'B':
+			bit = recfmB
+		case 'S':
+			bit = recfmS
+		case 'A':
+			bit = recfmA
+		case 'M':
+			bit = recfmM
+		}
+		if bit == 0 || !strings.ContainsRune(allowed, ch) ||
+			recfm&bit != 0 {
+			return 0, invalidInput("RECFM %s is invalid", s)
+		}
+		recfm |= bit
+	}
+	if recfm&recfmA != 0 && recfm&recfmM != 0 {
+		return 0, invalidInput("RECFM can't have both A and M")
+	}
+	return recfm, nil
+}
+
+// recfmName converts a DCB RECFM to a record format such as FB or VBS. Only
+// the format, blocked and (for variable-length records) spanned bits are
+// named.
+func recfmName(recfm byte) string {
+	var s string
+	switch recfm & recfmU {
+	case recfmF:
+		s = "F"
+	case recfmV:
+		s = "V"
+	case recfmU:
+		s = "U"
+	}
+
+	// Additionally, we can add a "B" for blocked
+	if recfm&recfmB != 0 {
+		s += "B"
+	}
+
+	// And if it's variable, it can be spanned
+	if recfm&recfmU == recfmV && recfm&recfmS != 0 {
+		s += "S"
+	}
+	return s
+}
+
+// checkBlocking checks that the record length and block size are consistent
+// with the record format.
+func checkBlocking(recfm byte, lrecl, blksize int) error {
+	if blksize < 1 || blksize > maxBlockSize {
+		return invalidInput("BLKSIZE must be between 1 and %d", maxBlockSize)
+	}
+	if lrecl < 0 || lrecl > maxBlockSize {
+		// 0 is only allowed for RECFM=U, which is checked below.
+		return invalidInput("LRECL must be between 0 and %d", maxBlockSize)
+	}
+
+	blocked := recfm&recfmB != 0
+	spanned := recfm&recfmS != 0
+	switch recfm & recfmU {
+	case recfmF:
+		switch {
+		case lrecl == 0:
+			return invalidInput("LRECL must be between 1 and %d for "+
+				"fixed-length records", maxBlockSize)
+		case blocked && blksize%lrecl != 0:
+			return invalidInput("BLKSIZE must be a multiple of LRECL for " +
+				"blocked fixed-length records")
+		case !blocked && blksize != lrecl:
+			return invalidInput("BLKSIZE must equal LRECL for unblocked " +
+				"fixed-length records")
+		}
+	case recfmV:
+		// LRECL includes the 4-byte RDW, and each block has a 4-byte BDW.
+		switch {
+		case lrecl < 5:
+			return invalidInput("LRECL must be at least 5 for " +
+				"variable-length records")
+		case blksize < 8:
+			return invalidInput("BLKSIZE must be at least 8 for " +
+				"variable-length records")
+		case !spanned && blksize < lrecl+4:
+			return invalidInput("BLKSIZE must be at least LRECL+4 for " +
+				"variable-length records that aren't spanned")
+		}
+	case recfmU:
+		if lrecl > blksize {
+			return invalidInput("LRECL can't be larger than BLKSIZE")
+		}
+	}
+	return nil
+}
+
+// appendQuantity appends n to b as a 3-byte quantity.
+func appendQuantity(b []byte, n int) []byte {
+	return append(b, byte(n>>16), byte(n>>8), byte(n))
+}
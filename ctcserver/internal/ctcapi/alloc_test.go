@@ -0,0 +1,52 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckBlocking(t *testing.T) {
+	tests := []struct {
+		recfm          byte
+		lrecl, blksize int
+		want           string // empty if the combination is valid
+	}{
+		{recfmF | recfmB, 80, 3120, ""},
+		{recfmF, 80, 80, ""},
+		{recfmV | recfmB, 255, 3120, ""},
+		{recfmU, 0, 6144, ""},
+		{recfmU, -1, 6144, "LRECL must be between 0 and 32760"},
+		{recfmU, 32761, 6144, "LRECL must be between 0 and 32760"},
+		{recfmF, 0, 80, "LRECL must be between 1 and 32760 for " +
+			"fixed-length records"},
+		{recfmF | recfmB, 80, 3000, "BLKSIZE must be a multiple of LRECL " +
+			"for blocked fixed-length records"},
+		{recfmV, 4, 3120, "LRECL must be at least 5 for variable-length " +
+			"records"},
+		{recfmU, 100, 80, "LRECL can't be larger than BLKSIZE"},
+	}
+
+	for _, tt := range tests {
+		err := checkBlocking(tt.recfm, tt.lrecl, tt.blksize)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("checkBlocking(%02x, %d, %d) = %v, want nil", tt.recfm,
+				tt.lrecl, tt.blksize, err)
+		case tt.want != "" && (err == nil || err.Error() != tt.want):
+			t.Errorf("checkBlocking(%02x, %d, %d) = %v, want %q", tt.recfm,
+				tt.lrecl, tt.blksize, err, tt.want)
+		case err != nil && !errors.Is(err, ErrInvalidInput):
+			t.Errorf("checkBlocking(%02x, %d, %d) error doesn't match "+
+				"ErrInvalidInput", tt.recfm, tt.lrecl, tt.blksize)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// Capabilities describes the version of a CTCSERV task, the commands it
+// supports, and the job it's running as.
+type Capabilities struct {
+	// Version is the CTCSERV protocol version. Version 0 is a CTCSERV from
+	// before the CAPS command was added, which supports only the original
+	// commands.
+	Version uint32 `json:"version"`
+
+	// Operations are the names of the supported commands.
+	Operations []string `json:"operations"`
+
+	// JobName and JobID identify the job CTCSERV is running as. They're
+	// empty if CTCSERV doesn't support the IDENTIFY command.
+	JobName string `json:"job_name,omitempty"`
+	JobID   string `json:"job_id,omitempty"`
+
+	// ops is the bitmap of supported opcodes: bit n, counting from the
+	// high-order bit of the first byte, is on if opcode n is supported.
+	ops [32]byte
+}
+
+// opNames are the names of the opcodes, as reported in
+// Capabilities.Operations.
+var opNames = map[opcode]string{
+	opDSList:   "dslist",
+	opMbrList:  "mbrlist",
+	opRead:     "read",
+	opSubmit:   "submit",
+	opWrite:    "write",
+	opCaps:     "capabilities",
+	opIdentify: "identify",
+	opAllocate: "allocate",
+	opDSMaint:  "dsmaint",
+	opMbrMaint: "mbrmaint",
+	opVTOC:     "vtoc",
+	opVolList:  "vollist",
+	opConsole:  "console",
+	opSysInfo:  "sysinfo",
+	opQuit:     "quit",
+}
+
+func (o opcode) String() string {
+	if name, ok := opNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("opcode %02x", byte(o))
+}
+
+// legacyCapabilities are those of a CTCSERV that doesn't understand the CAPS
+// command.
+var legacyCapabilities = newCapabilities(0,
+	opDSList, opMbrList, opRead, opSubmit, opWrite, opQuit)
+
+func newCapabilities(version uint32, ops ...opcode) *Capabilities {
+	caps := &Capabilities{Version: version}
+	for _, op := range ops {
+		caps.ops[op/8] |= 0x80 >> (op % 8)
+	}
+	caps.Operations = caps.names()
+	return caps
+}
+
+func (caps *Capabilities) names() []string {
+	var names []string
+	for op := 0; op < 256; op++ {
+		if caps.supports(opcode(op)) {
+			names = append(names, opcode(op).String())
+		}
+	}
+	return names
+}
+
+func (caps *Capabilities) supports(op opcode) bool {
+	return caps.ops[op/8]&(0x80>>(op%8)) != 0
+}
+
+// handshakeTimeout bounds the CAPS command. A CTCSERV that doesn't understand
+// it never responds, so we don't want to wait the full CCW timeout to find
+// out.
+const handshakeTimeout = 5 * time.Second
+
+// resultUnknownCommand is the result code CTCSERV sends in response to an
+// opcode it doesn't recognize.
+const resultUnknownCommand = 0xFE
+
+// handshake learns the capabilities of the CTCSERV task serving the pair, and
+// the job it's running as, if they aren't already known. Unless the pair is
+// set to probe, CTCSERV is assumed to support only the original commands
+// without asking. If CTCSERV doesn't respond to the CAPS command in time,
+// it's assumed to be a version without it; the link will have been reset, so
+// the pair can't be used until it reconnects.
+func (p *pair) handshake(ctx context.Context) error {
+	if p.capabilities() != nil {
+		return nil
+	}
+	if !p.probe {
+		p.setCapabilities(legacyCapabilities)
+		return nil
+	}
+
+	p.mu.Lock()
+	p.handshaking = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.handshaking = false
+		p.mu.Unlock()
+	}()
+
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	caps, err := p.queryCaps(hctx)
+	var timeoutErr *ctc.TimeoutError
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() &&
+		ctx.Err() == nil {
+
+		log.Warn().Msgf("CTCSERV on adapter pair %d didn't respond to the "+
+			"CAPS command; assuming it supports only the original commands",
+			p.index)
+		p.setCapabilities(legacyCapabilities)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if caps.supports(opIdentify) {
+		if err := p.identify(hctx, caps); err != nil {
+			return err
+		}
+		log.Info().Msgf("CTCSERV on adapter pair %d is running as job %s "+
+			"(%s)", p.index, caps.JobName, caps.JobID)
+	}
+
+	log.Info().Msgf("CTCSERV on adapter pair %d is protocol version %d, "+
+		"supporting %v", p.index, caps.Version, caps.Operations)
+	p.setCapabilities(caps)
+	return nil
+}
+
+// queryCaps sends the CAPS command and decodes the response.
+func (p *pair) queryCaps(ctx context.Context) (*Capabilities, error) {
+	if err := p.sendCommand(ctx, opCaps, nil); err != nil {
+		return nil, err
+	}
+
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CAPS response: %w", err)
+	}
+
+	if len(data) == 4 &&
+		binary.BigEndian.Uint32(data) == resultUnknownCommand {
+		return legacyCapabilities, nil
+	}
+	if len(data) != 40 {
+		return nil, fmt.Errorf("got %d bytes of CAPS response, expected 40",
+			len(data))
+	}
+	if rc := binary.BigEndian.Uint32(data[0:4]); rc != 0 {
+		return nil, &ResultError{Op: "CAPS", Code: rc}
+	}
+
+	caps := &Capabilities{Version: binary.BigEndian.Uint32(data[4:8])}
+	copy(caps.ops[:], data[8:40])
+	caps.Operations = caps.names()
+	return caps, nil
+}
+
+// identify sends the IDENTIFY command, recording the job name and ID of the
+// CTCSERV task in caps.
+func (p *pair) identify(ctx context.Context, caps *Capabilities) error {
+	if err := p.sendCommand(ctx, opIdentify, nil); err != nil {
+		return err
+	}
+
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't read IDENTIFY response: %w", err)
+	}
+
+	if len(data) != 20 {
+		return fmt.Errorf("got %d bytes of IDENTIFY response, expected 20",
+			len(data))
+	}
+	if rc := binary.BigEndian.Uint32(data[0:4]); rc != 0 {
+		return &ResultError{Op: "IDENTIFY", Code: rc}
+	}
+
+	caps.JobName = ebcdicName(data[4:12])
+	caps.JobID = ebcdicName(data[12:20])
+	return nil
+}
+
+func (p *pair) capabilities() *Capabilities {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.caps
+}
+
+func (p *pair) setCapabilities(caps *Capabilities) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.caps = caps
+}
+
+// Capabilities returns the capabilities of the CTCSERV task serving one of
+// the adapter pairs.
+func (c *ctcapi) Capabilities(ctx context.Context) (*Capabilities, error) {
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	return p.capabilities(), nil
+}
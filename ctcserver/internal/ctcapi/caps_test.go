@@ -0,0 +1,75 @@
+package ctcapi_test
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctcapi"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/mvsmock"
+)
+
+func TestHandshake(t *testing.T) {
+	api := newMockAPI(t, mvsmock.New(), true)
+	ctx := testContext(t)
+
+	caps, err := api.Capabilities(ctx)
+	if err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	if caps.Version != mvsmock.Version {
+		t.Errorf("version is %d, want %d", caps.Version, mvsmock.Version)
+	}
+	if !slices.Contains(caps.Operations, "sysinfo") {
+		t.Errorf("operations %v don't include sysinfo", caps.Operations)
+	}
+	if caps.JobName == "" {
+		t.Error("job name is empty after IDENTIFY")
+	}
+}
+
+// TestNoHandshake checks that without the handshake, a CTCSERV from before
+// the CAPS command serves the original commands without the link being
+// reset.
+func TestNoHandshake(t *testing.T) {
+	server := mvsmock.New()
+	server.Legacy = true
+	server.AddDataset(&mvsmock.Dataset{Name: "HERC01.TEST.DATA"})
+	api := newMockAPI(t, server, false)
+	ctx := testContext(t)
+
+	caps, err := api.Capabilities(ctx)
+	if err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	if caps.Version != 0 {
+		t.Errorf("version is %d, want 0", caps.Version)
+	}
+
+	list, err := api.GetDSList(ctx, "HERC01")
+	if err != nil {
+		t.Fatalf("GetDSList: %v", err)
+	}
+	if len(list) != 1 || list[0].Name != "HERC01.TEST.DATA" {
+		t.Errorf("GetDSList returned %v, want HERC01.TEST.DATA", list)
+	}
+
+	if _, err := api.ListVolumes(ctx); !errors.Is(err,
+		ctcapi.ErrUnsupported) {
+
+		t.Errorf("ListVolumes returned %v, want ErrUnsupported", err)
+	}
+	if state := api.LinkState(); state != ctc.StateConnected {
+		t.Errorf("link state is %v, want connected", state)
+	}
+}
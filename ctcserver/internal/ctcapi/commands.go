@@ -10,8 +10,9 @@ package ctcapi
 // https://github.com/racingmars/ctc-mainframe-api/
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -21,7 +22,15 @@ import (
 	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
 )
 
+// DSInfo describes a dataset found by a catalog search. Apart from Type, Name
+// and Volume, which come from the catalog, the attributes are decoded from
+// the format-1 DSCB; see decodeDSCB.
 type DSInfo struct {
+	// The fields up to LRecLen are encoded with their Go names, as they
+	// always have been in /api/dslist responses.
+	//
+	// Type is the catalog entry type, e.g. A for a non-VSAM dataset or X for
+	// an alias. It's empty for datasets found in a VTOC.
 	Type      string
 	Name      string
 	Volume    string
@@ -29,6 +38,40 @@ type DSInfo struct {
 	RecFM     string
 	BlockSize int
 	LRecLen   int
+
+	KeyLength int `json:"keylen"`
+
+	// Dates are in YYYY-MM-DD form, and empty if they're not recorded. MVS
+	// 3.8 only records the last-referenced date if it has been modified to
+	// do so.
+	Created        string `json:"created,omitempty"`
+	Expires        string `json:"expires,omitempty"`
+	LastReferenced string `json:"last_referenced,omitempty"`
+
+	// Extents is the number of extents the dataset occupies on the volume.
+	Extents int `json:"extents"`
+
+	// SpaceUnits is the unit of the space allocation: CYL, TRK, BLK (blocks
+	// of the average block length) or ABSTR (absolute tracks).
+	SpaceUnits string `json:"space_units,omitempty"`
+
+	// PrimaryQuantity isn't recorded by MVS, so it's the size of the first
+	// extent in SpaceUnits, or nil if that can't be worked out without
+	// knowing the geometry of the volume.
+	PrimaryQuantity   *int `json:"primary_quantity,omitempty"`
+	SecondaryQuantity int  `json:"secondary_quantity"`
+
+	// UsedTracks is the number of tracks up to and including the last one
+	// written, from DS1LSTAR.
+	UsedTracks int `json:"used_tracks"`
+
+	// RACFProtected is true if the dataset is defined to RACF (or another
+	// security product).
+	RACFProtected bool `json:"racf_protected"`
+
+	// Password is the dataset's password protection: "read" if a password is
+	// needed to read or write it, "write" if only to write it, or empty.
+	Password string `json:"password,omitempty"`
 }
 
 var dsprefixRegex = regexp.MustCompile(
@@ -44,14 +87,16 @@ var dsnameOptionalMemberRegex = regexp.MustCompile(
 		`(?:\.[a-zA-Z$#@-][a-zA-Z0-9$#@-]{0,7})*)` +
 		`(?:\(([a-zA-Z$#@-][a-zA-Z0-9$#@-]{0,7})\))?$`)
 
-func (c *ctcapi) GetDSList(basename string) ([]DSInfo, error) {
+func (c *ctcapi) GetDSList(ctx context.Context,
+	basename string) ([]DSInfo, error) {
+
 	if len(basename) > 44 {
-		return nil, fmt.Errorf("dataset name too long; got %d characters "+
+		return nil, invalidInput("dataset name too long; got %d characters "+
 			"but needs to be 44 or fewer", len(basename))
 	}
 
 	if !dsprefixRegex.MatchString(basename) {
-		return nil, fmt.Errorf("dataset search prefix is invalid")
+		return nil, invalidInput("dataset search prefix is invalid")
 	}
 
 	// Always treat a bare HLQ as a complete, specific HLQ and add a period to
@@ -67,18 +112,21 @@ func (c *ctcapi) GetDSList(basename string) ([]DSInfo, error) {
 	log.Debug().Hex("ebcdic", basenameEbcdic).Msgf(
 		"GetDSList(): performing catalog search for '%s'", basename)
 
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
 
-	if err := c.sendCommand(opDSList, basenameEbcdic); err != nil {
+	if err := p.sendCommand(ctx, opDSList, basenameEbcdic); err != nil {
 		log.Error().Err(err).Send()
 		return nil, err
 	}
 
 	log.Debug().Msg("GetDSList(): reading initial response")
-	data, err := c.ctcdata.SenseRead()
+	data, err := p.ctcdata.SenseRead(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("GetDSList(): couldn't perform SenseRead(): %v",
+		return nil, fmt.Errorf("GetDSList(): couldn't perform SenseRead(): %w",
 			err)
 	}
 	if len(data) != 6 {
@@ -91,8 +139,7 @@ func (c *ctcapi) GetDSList(basename string) ([]DSInfo, error) {
 	if resultCode != 0 {
 		log.Info().Msgf("GetDSList(): unsuccessful result code: %02x",
 			resultCode)
-		return nil, fmt.Errorf("unsuccessful catalog search result code: %02x",
-			resultCode)
+		return nil, &ResultError{Op: "DSLIST", Code: resultCode}
 	}
 
 	log.Debug().Msgf("GetDSList(): number of results: %d", numEntries)
@@ -100,7 +147,7 @@ func (c *ctcapi) GetDSList(basename string) ([]DSInfo, error) {
 	var entries []DSInfo
 	for i := 0; i < int(numEntries); i++ {
 		log.Debug().Msgf("GetDSList(): reading item %d of %d", i+1, numEntries)
-		data, err := c.ctcdata.SenseRead()
+		data, err := p.ctcdata.SenseRead(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -113,74 +160,72 @@ func (c *ctcapi) GetDSList(basename string) ([]DSInfo, error) {
 			continue
 		}
 
-		var dsinfo DSInfo
-		dsinfo.Type = ctc.EtoS(data[0:1])
-		dsinfo.Name = strings.TrimSpace(ctc.EtoS(data[1:45]))
-		dsinfo.Volume = strings.TrimSpace(ctc.EtoS(data[45:51]))
+		dsinfo := decodeDSInfo(data)
 
-		// data[] starting at index 51 corresponds to the 96 bytes of a
-		// (likely) format-1 DSCB beginning at offset 44/0x2C (that is, the 96
-		// bytes returned as part of the OBTAIN macro).
+		entries = append(entries, dsinfo)
+	}
 
-		if data[51] != 0xF1 && dsinfo.Type != "X" {
-			log.Warn().Msgf("GetDSLIST(): unexpected DSCB format type: "+
-				"expecting F1, but got %02x for %s", data[51], dsinfo.Name)
-		}
+	return entries, nil
+}
 
-		// For DSORG bit definitions, see DS1DSORG in SYS1.AMODGEN(IECSDSL1)
-		switch {
-		case data[89]&0x80 > 0:
-			dsinfo.DSOrg = "IS"
-		case data[89]&0x40 > 0:
-			dsinfo.DSOrg = "PS"
-		case data[89]&0x20 > 0:
-			dsinfo.DSOrg = "DA"
-		case data[89]&0x10 > 0:
-			dsinfo.DSOrg = "CX"
-		case data[89]&0x02 > 0:
-			dsinfo.DSOrg = "PO"
-		case data[90]&0x08 > 0: // note 2nd byte of DS1DSORG
-			dsinfo.DSOrg = "VS"
-		default:
-			dsinfo.DSOrg = "Unk"
-		}
+// decodeDSInfo decodes a 147-byte DSLIST entry: the catalog entry type,
+// dataset name and volume, followed by the 96 bytes of the format-1 DSCB
+// returned by OBTAIN.
+func decodeDSInfo(data []byte) DSInfo {
+	var dsinfo DSInfo
+	dsinfo.Type = ctc.EtoS(data[0:1])
+	dsinfo.Name = strings.TrimSpace(ctc.EtoS(data[1:45]))
+	dsinfo.Volume = strings.TrimSpace(ctc.EtoS(data[45:51]))
 
-		switch {
-		case data[91]&0xC0 == 0x80:
-			dsinfo.RecFM = "F"
-		case data[91]&0xC0 == 0x40:
-			dsinfo.RecFM = "V"
-		case data[91]&0xC0 == 0xC0:
-			dsinfo.RecFM = "U"
-		}
+	// data[] starting at index 51 corresponds to the 96 bytes of a
+	// (likely) format-1 DSCB beginning at offset 44/0x2C (that is, the 96
+	// bytes returned as part of the OBTAIN macro).
 
-		// Additionally, we can add a "B" for blocked
-		if data[91]&0x10 == 0x10 {
-			dsinfo.RecFM += "B"
-		}
+	if data[51] != 0xF1 && dsinfo.Type != "X" {
+		log.Warn().Msgf("unexpected DSCB format type: expecting F1, but "+
+			"got %02x for %s", data[51], dsinfo.Name)
+	}
 
-		// And if it's variable, it can be spanned
-		if data[91]&0xC0 == 0x40 && data[91]&0x08 == 0x08 {
-			dsinfo.RecFM += "S"
-		}
+	// For DSORG bit definitions, see DS1DSORG in SYS1.AMODGEN(IECSDSL1)
+	switch {
+	case data[89]&0x80 > 0:
+		dsinfo.DSOrg = "IS"
+	case data[89]&0x40 > 0:
+		dsinfo.DSOrg = "PS"
+	case data[89]&0x20 > 0:
+		dsinfo.DSOrg = "DA"
+	case data[89]&0x10 > 0:
+		dsinfo.DSOrg = "CX"
+	case data[89]&0x02 > 0:
+		dsinfo.DSOrg = "PO"
+	case data[90]&0x08 > 0: // note 2nd byte of DS1DSORG
+		dsinfo.DSOrg = "VS"
+	default:
+		dsinfo.DSOrg = "Unk"
+	}
 
-		dsinfo.BlockSize = int(binary.BigEndian.Uint16(data[93:95]))
-		dsinfo.LRecLen = int(binary.BigEndian.Uint16(data[95:97]))
+	dsinfo.RecFM = recfmName(data[91])
 
-		entries = append(entries, dsinfo)
+	dsinfo.BlockSize = int(binary.BigEndian.Uint16(data[93:95]))
+	dsinfo.LRecLen = int(binary.BigEndian.Uint16(data[95:97]))
+
+	if data[51] == 0xF1 {
+		decodeDSCB(&dsinfo, data[51:147])
 	}
 
-	return entries, nil
+	return dsinfo
 }
 
-func (c *ctcapi) GetMemberList(pdsName string) ([]string, error) {
+func (c *ctcapi) GetMemberInfo(ctx context.Context,
+	pdsName, volume string) ([]MemberInfo, error) {
+
 	if len(pdsName) > 44 {
-		return nil, fmt.Errorf("dataset name too long; got %d characters "+
+		return nil, invalidInput("dataset name too long; got %d characters "+
 			"but needs to be 44 or fewer", len(pdsName))
 	}
 
 	if !dsnameRegex.MatchString(pdsName) {
-		return nil, fmt.Errorf("dataset name is invalid")
+		return nil, invalidInput("dataset name is invalid")
 	}
 
 	// The dataset name to MBRLIST must be 44 characters, padded with (EBCDIC)
@@ -192,46 +237,60 @@ func (c *ctcapi) GetMemberList(pdsName string) ([]string, error) {
 	}
 	copy(pdsPadded, pdsEbcdic)
 
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
+	// ...followed by the volume serial for an uncataloged dataset.
+	volparam, err := volumeParam(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	if err := p.checkVolume(volparam); err != nil {
+		return nil, err
+	}
 
 	log.Debug().Hex("pds", pdsEbcdic).Msgf("getting member list for '%s'",
 		pdsName)
 
-	if err := c.sendCommand(opMbrList, pdsPadded); err != nil {
-		log.Error().Err(err).Msg("sendCommand() error in GetMemberList()")
+	pdsPadded = append(pdsPadded, volparam...)
+	if err := p.sendCommand(ctx, opMbrList, pdsPadded); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in GetMemberInfo()")
 		return nil, err
 	}
 
-	log.Debug().Msg("GetMemberList(): reading initial response")
-	data, err := c.ctcdata.SenseRead()
+	log.Debug().Msg("GetMemberInfo(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
 	if err != nil {
 		return nil, fmt.Errorf(
-			"GetMemberList(): couldn't perform SenseRead(): %v", err)
+			"GetMemberInfo(): couldn't perform SenseRead(): %w", err)
 	}
 	if len(data) != 8 {
 		return nil, fmt.Errorf(
-			"GetMemberList(): got %d bytes in initial response but expected 8",
+			"GetMemberInfo(): got %d bytes in initial response but expected 8",
 			len(data))
 	}
 
 	resultCode := binary.BigEndian.Uint32(data[0:4])
 	if resultCode != 0 {
 		additionalCode := binary.BigEndian.Uint32(data[4:8])
-		log.Info().Msgf("GetMemberList(): unsuccessful result code: %02x/%02x",
-			resultCode, additionalCode)
-		return nil, fmt.Errorf("unsuccessful result code: %02x/%02x",
+		log.Info().Msgf("GetMemberInfo(): unsuccessful result code: %02x/%02x",
 			resultCode, additionalCode)
+		return nil, &ResultError{Op: "MBRLIST", Code: resultCode,
+			Additional: additionalCode}
 	}
 
-	var entries []string
+	var entries []MemberInfo
 	var i int
 	for {
 		i++
-		log.Debug().Msgf("GetMemberList(): reading item %d", i)
-		data, err := c.ctcdata.SenseRead()
+		log.Debug().Msgf("GetMemberInfo(): reading item %d", i)
+		data, err := p.ctcdata.SenseRead(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't read item %d: %v", i, err)
+			return nil, fmt.Errorf("couldn't read item %d: %w", i, err)
 		}
 		if len(data) < 8 {
 			log.Error().Msgf("got length %d member record, but expected >=8",
@@ -245,21 +304,35 @@ func (c *ctcapi) GetMemberList(pdsName string) ([]string, error) {
 			data[3] == 0xFF && data[4] == 0xFF && data[5] == 0xFF &&
 			data[6] == 0xFF && data[7] == 0xFF {
 			// last member entry all high bytes. Done
-			log.Debug().Msg("GetMemberList(): got end record")
+			log.Debug().Msg("GetMemberInfo(): got end record")
 			break
 		}
 
-		name := strings.TrimRight(ctc.EtoS(data[0:8]), " ")
-		entries = append(entries, name)
+		entries = append(entries, decodeMember(data))
 	}
 
 	return entries, nil
 }
 
-func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
+func (c *ctcapi) Read(ctx context.Context, dsn, volume string,
+	raw bool) ([][]byte, error) {
+
+	var entries [][]byte
+	err := c.ReadStream(ctx, dsn, volume, raw, func(record []byte) error {
+		entries = append(entries, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *ctcapi) ReadStream(ctx context.Context, dsn, volume string,
+	raw bool, fn func(record []byte) error) error {
 
 	if !dsnameOptionalMemberRegex.MatchString(dsn) {
-		return nil, fmt.Errorf("dataset name is invalid")
+		return invalidInput("dataset name is invalid")
 	}
 
 	matches := dsnameOptionalMemberRegex.FindStringSubmatch(dsn)
@@ -267,11 +340,11 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 	mbrName := matches[2]
 
 	if len(pdsName) > 44 {
-		return nil, fmt.Errorf("dataset name too long; got %d characters "+
+		return invalidInput("dataset name too long; got %d characters "+
 			"but needs to be 44 or fewer", len(pdsName))
 	}
 	if len(mbrName) > 8 {
-		return nil, fmt.Errorf("member name too long; got %d characters "+
+		return invalidInput("member name too long; got %d characters "+
 			"but needs to be 8 or fewer", len(mbrName))
 	}
 
@@ -291,8 +364,20 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 	}
 	copy(mbrPadded, mbrEbcdic)
 
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
+	volparam, err := volumeParam(volume)
+	if err != nil {
+		return err
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(p)
+
+	if err := p.checkVolume(volparam); err != nil {
+		return err
+	}
 
 	log.Debug().Hex("pds", pdsEbcdic).Msgf("reading dataset '%s'",
 		pdsName)
@@ -301,21 +386,23 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 			mbrName)
 	}
 
-	// Complete input is the 44-byte DS name followed by 8-byte member
+	// Complete input is the 44-byte DS name followed by 8-byte member, and
+	// the volume serial if there is one
 	pdsPadded = append(pdsPadded, mbrPadded...)
+	pdsPadded = append(pdsPadded, volparam...)
 
-	if err := c.sendCommand(opRead, pdsPadded); err != nil {
+	if err := p.sendCommand(ctx, opRead, pdsPadded); err != nil {
 		log.Error().Err(err).Msg("sendCommand() error in ReadDS()")
-		return nil, err
+		return err
 	}
 
 	log.Debug().Msg("Read(): reading initial response")
-	data, err := c.ctcdata.SenseRead()
+	data, err := p.ctcdata.SenseRead(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Read(): couldn't perform SenseRead(): %v", err)
+		return fmt.Errorf("Read(): couldn't perform SenseRead(): %w", err)
 	}
 	if len(data) != 8 {
-		return nil, fmt.Errorf("Read(): got %d bytes of data, expected 8",
+		return fmt.Errorf("Read(): got %d bytes of data, expected 8",
 			len(data))
 	}
 
@@ -324,8 +411,8 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 		additionalCode := binary.BigEndian.Uint32(data[4:8])
 		log.Info().Msgf("Read(): unsuccessful result code: %02x/%02x",
 			resultCode, additionalCode)
-		return nil, fmt.Errorf("unsuccessful result code: %02x/%02x",
-			resultCode, additionalCode)
+		return &ResultError{Op: "READ", Code: resultCode,
+			Additional: additionalCode}
 	}
 	fixedCode := binary.BigEndian.Uint32(data[4:8])
 	fixed := false
@@ -334,14 +421,16 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 	}
 	log.Debug().Bool("fixed", fixed).Send()
 
-	var entries [][]byte
+	// If fn fails, we stop calling it but keep reading until the end of
+	// the dataset so that we stay in sync with CTCSERV.
+	var fnErr error
 	var i int
 	for {
 		i++
 		log.Debug().Msgf("Read(): reading record %d", i)
-		data, err := c.ctcdata.SenseRead()
+		data, err := p.ctcdata.SenseRead(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if len(data) == 1 && data[0] == 0xFF {
@@ -369,25 +458,33 @@ func (c *ctcapi) Read(dsn string, raw bool) ([][]byte, error) {
 			data = data[0:recl]
 		}
 
+		if fnErr != nil {
+			continue
+		}
+
 		if raw {
-			entries = append(entries, data)
+			fnErr = fn(data)
 		} else {
 			if !fixed {
 				// Trim the RDW
 				data = data[4:]
 			}
 			record := strings.TrimRight(ctc.EtoS(data), " ")
-			entries = append(entries, []byte(record))
+			fnErr = fn([]byte(record))
+		}
+		if fnErr != nil {
+			log.Warn().Err(fnErr).Msgf("Read(): record %d not accepted; "+
+				"discarding remaining records", i)
 		}
 	}
 
-	return entries, nil
+	return fnErr
 }
 
-func (c *ctcapi) Submit(jcl []string) (string, error) {
+func (c *ctcapi) Submit(ctx context.Context, jcl []string) (string, error) {
 	// Confirm we have some JCL
 	if len(jcl) < 1 {
-		err := fmt.Errorf("JCL must contain at least 1 record")
+		err := invalidInput("JCL must contain at least 1 record")
 		log.Debug().Err(err).Msg("invalid JCL in Submit")
 		return "", err
 	}
@@ -395,7 +492,7 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 	// Confirm all lines are <=80 characters
 	for i := range jcl {
 		if len(jcl[i]) > 80 {
-			err := fmt.Errorf(
+			err := invalidInput(
 				"line %d of JCL is %d characters; must be <= 80",
 				i+1, len(jcl[i]))
 			log.Debug().Err(err).Msg("invalid JCL in Submit")
@@ -403,19 +500,22 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 		}
 	}
 
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.release(p)
 
 	log.Debug().Msgf("sending submit command with %d job lines", len(jcl))
 
 	recordCountBytes := binary.BigEndian.AppendUint32(nil, uint32(len(jcl)))
-	if err := c.sendCommand(opSubmit, recordCountBytes); err != nil {
+	if err := p.sendCommand(ctx, opSubmit, recordCountBytes); err != nil {
 		return "", err
 	}
 
-	data, err := c.ctcdata.SenseRead()
+	data, err := p.ctcdata.SenseRead(ctx)
 	if err != nil {
-		return "", fmt.Errorf("Submit(): couldn't perform SenseRead(): %v",
+		return "", fmt.Errorf("Submit(): couldn't perform SenseRead(): %w",
 			err)
 	}
 	if len(data) != 4 {
@@ -425,8 +525,9 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 
 	resultCode := binary.BigEndian.Uint32(data[0:4])
 	if resultCode != 0 {
-		return "", fmt.Errorf("unsuccessful result code: %02x",
+		log.Info().Msgf("Submit(): unsuccessful result code: %02x",
 			resultCode)
+		return "", &ResultError{Op: "SUBMIT", Code: resultCode}
 	}
 	log.Debug().Msgf("Submit(): initial response code: %08x", data[0:4])
 
@@ -441,15 +542,15 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 		copy(padded, e)
 
 		log.Debug().Msg("Submit(): sending JCL record")
-		if err := c.ctccmd.ControlWrite(padded); err != nil {
-			return "", fmt.Errorf("error writing JCL record: %v", err)
+		if err := p.ctccmd.ControlWrite(ctx, padded); err != nil {
+			return "", fmt.Errorf("error writing JCL record: %w", err)
 		}
 
 		// We also expect a response on the data channel
 		log.Debug().Msg("Submit(): reading response")
-		data, err := c.ctcdata.SenseRead()
+		data, err := p.ctcdata.SenseRead(ctx)
 		if err != nil {
-			return "", fmt.Errorf("error reading JCL record response: %v", err)
+			return "", fmt.Errorf("error reading JCL record response: %w", err)
 		}
 
 		if len(data) != 4 {
@@ -460,18 +561,17 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 			data, i)
 		resultCode := binary.BigEndian.Uint32(data[0:4])
 		if resultCode != 0 {
-			errmsg := fmt.Errorf(
-				"Submit(): unsuccessful result code %08x after record %d",
-				data, i)
-			log.Error().Msgf("%v", errmsg)
+			errmsg := &ResultError{Op: "SUBMIT", Code: resultCode,
+				Record: i + 1}
+			log.Error().Err(errmsg).Msg("Submit(): unsuccessful result code")
 			return "", errmsg
 		}
 	}
 
 	log.Debug().Msg("Submit(): getting job number")
-	data, err = c.ctcdata.SenseRead()
+	data, err = p.ctcdata.SenseRead(ctx)
 	if err != nil {
-		return "", fmt.Errorf("error reading job number: %v", err)
+		return "", fmt.Errorf("error reading job number: %w", err)
 	}
 
 	if !(len(data) == 12 || len(data) == 4) {
@@ -480,210 +580,77 @@ func (c *ctcapi) Submit(jcl []string) (string, error) {
 	}
 	resultCode = binary.BigEndian.Uint32(data[0:4])
 	if resultCode != 0 {
-		errmsg := fmt.Errorf("Submit(): unexpected final response code %08x",
-			data[0:4])
-		log.Error().Msgf("%v", errmsg)
-		return "", err
+		errmsg := &ResultError{Op: "SUBMIT", Code: resultCode}
+		log.Error().Err(errmsg).Msg("Submit(): unexpected final response code")
+		return "", errmsg
 	}
 
 	jobnum := ctc.EtoS(data[4:])
 
-	log.Debug().Msgf("Submit(): job number is %s", jobnum)
-	return jobnum, nil
-}
-
-func (c *ctcapi) Write(dsn string, inputds []string) error {
-	// Confirm we have some records
-	if len(inputds) < 1 {
-		err := fmt.Errorf("Data must contain at least 1 record")
-		log.Debug().Err(err).Msg("invalid data in Submit")
-		return err
-	}
-
-	if !dsnameOptionalMemberRegex.MatchString(dsn) {
-		return fmt.Errorf("dataset name is invalid")
-	}
-
-	matches := dsnameOptionalMemberRegex.FindStringSubmatch(dsn)
-	pdsName := matches[1]
-	mbrName := matches[2]
+	// We can only tell that JES2 rejected the job if CTCSERV told us its
+	// own job ID; older versions don't support IDENTIFY.
+	if caps := p.capabilities(); caps != nil && caps.JobID != "" &&
+		strings.TrimRight(jobnum, " ") == caps.JobID {
 
-	if len(pdsName) > 44 {
-		return fmt.Errorf("dataset name too long; got %d characters "+
-			"but needs to be 44 or fewer", len(pdsName))
-	}
-	if len(mbrName) > 8 {
-		return fmt.Errorf("member name too long; got %d characters "+
-			"but needs to be 8 or fewer", len(mbrName))
+		errmsg := &JobRejectedError{ServerJobID: caps.JobID}
+		log.Error().Err(errmsg).Msg("Submit(): job rejected")
+		return "", errmsg
 	}
 
-	// The dataset name must be 44 characters, padded with (EBCDIC) spaces.
-	pdsEbcdic := ctc.StoE(strings.ToUpper(pdsName))
-	pdsPadded := make([]byte, 44)
-	for i := range pdsPadded {
-		pdsPadded[i] = 0x40
-	}
-	copy(pdsPadded, pdsEbcdic)
-
-	// The member name must be 8 characters, padded with (EBCDIC) spaces.
-	mbrEbcdic := ctc.StoE(strings.ToUpper(mbrName))
-	mbrPadded := make([]byte, 8)
-	for i := range mbrPadded {
-		mbrPadded[i] = 0x40
-	}
-	copy(mbrPadded, mbrEbcdic)
-
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
-
-	log.Debug().Hex("pds", pdsEbcdic).Msgf("writing dataset '%s'",
-		pdsName)
-	if len(mbrName) > 0 {
-		log.Debug().Hex("member", mbrEbcdic).Msgf("writing member '%s'",
-			mbrName)
-	}
-
-	// Complete input is the 44-byte DS name followed by 8-byte member
-	pdsPadded = append(pdsPadded, mbrPadded...)
-
-	if err := c.sendCommand(opWrite, pdsPadded); err != nil {
-		log.Error().Err(err).Msg("sendCommand() error in Write()")
-		return err
-	}
-
-	log.Debug().Msg("Write(): reading initial response")
-	data, err := c.ctcdata.SenseRead()
-	if err != nil {
-		return fmt.Errorf("Write(): couldn't perform SenseRead(): %v", err)
-	}
-	if len(data) != 8 {
-		return fmt.Errorf("Write(): got %d bytes of data, expected 8",
-			len(data))
-	}
-
-	resultCode := binary.BigEndian.Uint32(data[0:4])
-	if resultCode != 0 {
-		log.Info().Msgf("Write(): unsuccessful result code: %02x",
-			resultCode)
-		return fmt.Errorf("unsuccessful result code: %02x",
-			resultCode)
-	}
-	lrecl := binary.BigEndian.Uint32(data[4:8])
-
-	// Confirm all lines are <=lrecl characters
-	var lengthErr error
-	for i := range inputds {
-		if len(inputds[i]) > int(lrecl) {
-			lengthErr = fmt.Errorf(
-				"line %d of input is %d characters; must be <= %d",
-				i+1, len(inputds[i]), lrecl)
-			log.Debug().Err(err).Msg("invalid data length in Write()")
-		}
-	}
-
-	var proceedCommand int32
-	var numLines int32
-
-	if lengthErr != nil {
-		proceedCommand = 1
-	}
-	numLines = int32(len(inputds))
-
-	var initialRespBuf bytes.Buffer
-	binary.Write(&initialRespBuf, binary.BigEndian, proceedCommand)
-	binary.Write(&initialRespBuf, binary.BigEndian, numLines)
-
-	log.Debug().Msgf("Sending intent to proceed %02x with %d records",
-		proceedCommand, numLines)
-	if err := c.ctccmd.NakedWrite(initialRespBuf.Bytes()); err != nil {
-		return err
-	}
-
-	data, err = c.ctcdata.SenseRead()
-	if err != nil {
-		return fmt.Errorf("Write(): couldn't perform SenseRead() after "+
-			"intent to proceed: %v", err)
-	}
-	resultCode = binary.BigEndian.Uint32(data[0:4])
-	if resultCode != 0 {
-		log.Info().Msgf("Write(): unsuccessful result code after intent to "+
-			"proceed: %02x", resultCode)
-		return fmt.Errorf("unsuccessful result code after intend to "+
-			"proceed: %02x", resultCode)
-	}
-
-	log.Debug().Msgf("sending write command with %d records", len(inputds))
+	log.Debug().Msgf("Submit(): job number is %s", jobnum)
+	return jobnum, nil
+}
 
-	for i, line := range inputds {
-		// convert input line to a right-space-padded lrecl character record.
-		// (we already verified earlier that all lines are <= lcrecl characters)
-		e := ctc.StoE(line)
-		padded := make([]byte, lrecl)
-		for j := range padded {
-			padded[j] = 0x40
+// Quit will instruct the CTC server job on the MVS side to quit.
+func (c *ctcapi) Quit(ctx context.Context) error {
+	// Every pair has its own CTCSERV job, so we wait for all of them to
+	// become idle and tell each one to quit.
+	var pairs []*pair
+	defer func() {
+		for _, p := range pairs {
+			c.release(p)
 		}
-		copy(padded, e)
-
-		log.Debug().Msg("Write(): sending record")
-		if err := c.ctccmd.ControlWrite(padded); err != nil {
-			return fmt.Errorf("error writing record: %v", err)
+	}()
+	for range c.pairs {
+		select {
+		case p := <-c.idle:
+			pairs = append(pairs, p.take())
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-		// We also expect a response on the data channel
-		log.Debug().Msg("Write(): reading response")
-		data, err := c.ctcdata.SenseRead()
-		if err != nil {
-			return fmt.Errorf("error reading record response: %v", err)
-		}
+	log.Debug().Msg("sending quit command")
 
-		if len(data) != 8 {
-			return fmt.Errorf("got %d response length, expected 8",
-				len(data))
+	var errs []error
+	for _, p := range pairs {
+		if p.state() != ctc.StateConnected {
+			continue
 		}
-		log.Debug().Msgf("Write(): got response %08x after record %d",
-			data, i)
-		resultCode := binary.BigEndian.Uint32(data[0:4])
-		if resultCode != 0 {
-			errmsg := fmt.Errorf(
-				"Write(): unsuccessful result code %08x after record %d",
-				data, i)
-			log.Error().Msgf("%v", errmsg)
-			return errmsg
+		if err := p.sendCommand(ctx, opQuit, nil); err != nil {
+			log.Error().Err(err).Msgf("Quit(): error sending quit command "+
+				"to adapter pair %d", p.index)
+			errs = append(errs, err)
 		}
-	}
 
-	log.Debug().Msg("Write(): getting final result")
-	data, err = c.ctcdata.SenseRead()
-	if err != nil {
-		return fmt.Errorf("error reading final result: %v", err)
-	}
-
-	if len(data) != 8 {
-		return fmt.Errorf("unexpected final response length: %d",
-			len(data))
-	}
-	resultCode = binary.BigEndian.Uint32(data[0:4])
-	if resultCode != 0 {
-		errmsg := fmt.Errorf("Write(): unexpected final response code %08x",
-			data[0:4])
-		log.Error().Msgf("%v", errmsg)
-		return err
+		// Whatever CTCSERV is started next may be a different version.
+		p.setCapabilities(nil)
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-// Quit will instruct the CTC server job on the MVS side to quit.
-func (c *ctcapi) Quit() error {
-	c.ctcMutex.Lock()
-	defer c.ctcMutex.Unlock()
-
-	log.Debug().Msg("sending quit command")
+// ebcdicName converts a space-padded EBCDIC name field to a string.
+func ebcdicName(e []byte) string {
+	return strings.TrimRight(ctc.EtoS(e), " \x00")
+}
 
-	if err := c.sendCommand(opQuit, nil); err != nil {
-		log.Error().Err(err).Msgf("Quit(): error sending quit command")
-		return err
+// padEbcdic returns s in EBCDIC, padded with spaces to n bytes.
+func padEbcdic(s string, n int) []byte {
+	padded := make([]byte, n)
+	for i := range padded {
+		padded[i] = 0x40
 	}
-
-	return nil
+	copy(padded, ctc.StoE(s))
+	return padded
 }
@@ -0,0 +1,253 @@
+package ctcapi_test
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctcapi"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/mvsmock"
+)
+
+// newTestServer returns an emulated CTCSERV with a sequential dataset, a PDS
+// with one member, and a dataset that another job has allocated.
+func newTestServer() *mvsmock.Server {
+	server := mvsmock.New()
+	server.AddDataset(&mvsmock.Dataset{
+		Name:    "HERC01.TEST.SEQ",
+		Records: [][]byte{make([]byte, 80)},
+	})
+	server.AddDataset(&mvsmock.Dataset{
+		Name:  "HERC01.TEST.PDS",
+		DSOrg: "PO",
+		Members: map[string]*mvsmock.Member{
+			"MEMBER1": {Name: "MEMBER1"},
+			"MEMBER2": {Name: "MEMBER2"},
+		},
+	})
+	server.AddDataset(&mvsmock.Dataset{
+		Name:  "HERC01.TEST.BUSY",
+		InUse: true,
+	})
+	return server
+}
+
+func read(dsn, volume string) func(context.Context, ctcapi.CTCAPI) error {
+	return func(ctx context.Context, api ctcapi.CTCAPI) error {
+		_, err := api.Read(ctx, dsn, volume, false)
+		return err
+	}
+}
+
+func write(dsn string) func(context.Context, ctcapi.CTCAPI) error {
+	return func(ctx context.Context, api ctcapi.CTCAPI) error {
+		_, err := api.Write(ctx, dsn, []string{"HELLO"},
+			ctcapi.WriteOptions{})
+		return err
+	}
+}
+
+func memberList(dsn, volume string) func(context.Context,
+	ctcapi.CTCAPI) error {
+
+	return func(ctx context.Context, api ctcapi.CTCAPI) error {
+		_, err := api.GetMemberList(ctx, dsn, volume)
+		return err
+	}
+}
+
+// TestResultErrors runs commands that the emulated CTCSERV fails, and checks
+// that the *ResultError returned classifies the failure.
+func TestResultErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(context.Context, ctcapi.CTCAPI) error
+		code uint32
+		is   func(*ctcapi.ResultError) bool
+	}{
+		{
+			name: "dslist/not cataloged",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				_, err := api.GetDSList(ctx, "NOSUCH")
+				return err
+			},
+			code: 8,
+			is:   (*ctcapi.ResultError).NotCataloged,
+		},
+		{
+			name: "mbrlist/not cataloged",
+			run:  memberList("HERC01.NOSUCH", ""),
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).NotCataloged,
+		},
+		{
+			name: "mbrlist/not partitioned",
+			run:  memberList("HERC01.TEST.SEQ", ""),
+			code: ctcapi.ResultFormat,
+		},
+		{
+			name: "mbrlist/in use",
+			run:  memberList("HERC01.TEST.BUSY", ""),
+			code: ctcapi.ResultDynalloc,
+			is:   (*ctcapi.ResultError).InUse,
+		},
+		{
+			name: "read/not cataloged",
+			run:  read("HERC01.NOSUCH", ""),
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).NotCataloged,
+		},
+		{
+			name: "read/not on volume",
+			run:  read("HERC01.NOSUCH", mvsmock.DefaultVolume),
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).NotOnVolume,
+		},
+		{
+			name: "read/volume not mounted",
+			run:  read("HERC01.TEST.SEQ", "NOVOL1"),
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).VolumeNotMounted,
+		},
+		{
+			name: "read/in use",
+			run:  read("HERC01.TEST.BUSY", ""),
+			code: ctcapi.ResultDynalloc,
+			is:   (*ctcapi.ResultError).InUse,
+		},
+		{
+			name: "read/member not found",
+			run:  read("HERC01.TEST.PDS(NOSUCH)", ""),
+			code: ctcapi.ResultNoMember,
+			is:   (*ctcapi.ResultError).MemberNotFound,
+		},
+		{
+			name: "read/member of sequential dataset",
+			run:  read("HERC01.TEST.SEQ(MEMBER1)", ""),
+			code: ctcapi.ResultFormat,
+		},
+		{
+			name: "write/not cataloged",
+			run:  write("HERC01.NOSUCH"),
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).NotCataloged,
+		},
+		{
+			name: "write/in use",
+			run:  write("HERC01.TEST.BUSY"),
+			code: ctcapi.ResultDynalloc,
+			is:   (*ctcapi.ResultError).InUse,
+		},
+		{
+			name: "allocate/exists",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				_, err := api.Allocate(ctx, "HERC01.TEST.SEQ",
+					ctcapi.Allocation{DSOrg: "PS", RecFM: "FB",
+						LRecLen: 80, BlockSize: 3120, SpaceUnits: "TRK",
+						Primary: 1})
+				return err
+			},
+			code: ctcapi.ResultExists,
+			is:   (*ctcapi.ResultError).Exists,
+		},
+		{
+			name: "dsmaint/not cataloged",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				return api.DeleteDataset(ctx, "HERC01.NOSUCH", false)
+			},
+			code: ctcapi.ResultLocate,
+			is:   (*ctcapi.ResultError).NotCataloged,
+		},
+		{
+			name: "dsmaint/new name exists",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				return api.RenameDataset(ctx, "HERC01.TEST.SEQ",
+					"HERC01.TEST.PDS", false)
+			},
+			code: ctcapi.ResultExists,
+			is:   (*ctcapi.ResultError).Exists,
+		},
+		{
+			name: "mbrmaint/member not found",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				return api.DeleteMember(ctx, "HERC01.TEST.PDS", "NOSUCH",
+					false)
+			},
+			code: ctcapi.ResultNoMember,
+			is:   (*ctcapi.ResultError).MemberNotFound,
+		},
+		{
+			name: "mbrmaint/new name exists",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				return api.RenameMember(ctx, "HERC01.TEST.PDS", "MEMBER1",
+					"MEMBER2", false)
+			},
+			code: ctcapi.ResultExists,
+			is:   (*ctcapi.ResultError).Exists,
+		},
+		{
+			name: "mbrmaint/not partitioned",
+			run: func(ctx context.Context, api ctcapi.CTCAPI) error {
+				return api.DeleteMember(ctx, "HERC01.TEST.SEQ", "MEMBER1",
+					false)
+			},
+			code: ctcapi.ResultFormat,
+		},
+	}
+
+	api := newMockAPI(t, newTestServer(), true)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(testContext(t), api)
+			var rerr *ctcapi.ResultError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("got error %v, want a *ResultError", err)
+			}
+			if rerr.Code != tt.code {
+				t.Errorf("result code is %02x, want %02x", rerr.Code,
+					tt.code)
+			}
+			if tt.is != nil && !tt.is(rerr) {
+				t.Errorf("error %q isn't classified as expected", rerr)
+			}
+		})
+	}
+
+	// The emulation is still in step with the client after every failure.
+	if _, err := api.Read(testContext(t), "HERC01.TEST.SEQ", "",
+		false); err != nil {
+
+		t.Errorf("Read after failures: %v", err)
+	}
+}
+
+// TestDryRun checks that a dry run reports success without changing
+// anything.
+func TestDryRun(t *testing.T) {
+	server := newTestServer()
+	api := newMockAPI(t, server, true)
+	ctx := testContext(t)
+
+	if err := api.DeleteDataset(ctx, "HERC01.TEST.SEQ", true); err != nil {
+		t.Fatalf("DeleteDataset dry run: %v", err)
+	}
+	if server.Dataset("HERC01.TEST.SEQ") == nil {
+		t.Error("dataset was deleted by a dry run")
+	}
+
+	if err := api.DeleteDataset(ctx, "HERC01.TEST.SEQ", false); err != nil {
+		t.Fatalf("DeleteDataset: %v", err)
+	}
+	if server.Dataset("HERC01.TEST.SEQ") != nil {
+		t.Error("dataset wasn't deleted")
+	}
+}
@@ -0,0 +1,199 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// ConsoleMessage is a message written to the MVS console.
+type ConsoleMessage struct {
+	// Sequence is the number MVS gave the message. Later messages have
+	// higher numbers.
+	Sequence uint32 `json:"sequence"`
+
+	// Time is the time stamp MVS gave the message, as HH.MM.SS.
+	Time string `json:"time"`
+
+	// MessageID is the first word of the message if it looks like a message
+	// ID, such as IEF403I or $HASP373, or empty.
+	MessageID string `json:"message_id,omitempty"`
+	Text      string `json:"text"`
+}
+
+// ConsoleNow is passed to ReadConsole to start with the messages written
+// from now on.
+const ConsoleNow uint32 = 0xFFFFFFFF
+
+// MaxConsoleWait is the longest IssueCommand will collect messages for.
+const MaxConsoleWait = 60 * time.Second
+
+// consoleSlice is the longest a single CONSOLE command collects messages
+// for. Longer waits are made up of several commands, so that no CCW exchange
+// runs into the CTC timeout while CTCSERV waits for messages.
+const consoleSlice = 10 * time.Second
+
+// messageIDRegex matches MVS and JES2 message IDs.
+var messageIDRegex = regexp.MustCompile(`^\$?[A-Z]{3,5}[0-9]{3,4}[A-Z]?$`)
+
+// IssueCommand issues an MVS operator command and returns the console
+// messages written while waiting for wait afterward, which include the
+// command's response but may include unrelated messages too.
+func (c *ctcapi) IssueCommand(ctx context.Context, command string,
+	wait time.Duration) ([]ConsoleMessage, error) {
+
+	command = strings.ToUpper(strings.TrimSpace(command))
+	if command == "" {
+		return nil, invalidInput("command is required")
+	}
+	if len(command) > 126 {
+		return nil, invalidInput("command is longer than 126 characters")
+	}
+	for _, r := range command {
+		if r < ' ' || r > '~' {
+			return nil, invalidInput("command contains characters that " +
+				"can't be sent to MVS")
+		}
+	}
+	if wait < 0 || wait > MaxConsoleWait {
+		return nil, invalidInput("wait must be from 0 to %d seconds",
+			int(MaxConsoleWait/time.Second))
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Msgf("issuing operator command '%s'", command)
+
+	// The first CONSOLE command issues the operator command; the rest just
+	// carry on collecting from the last message it returned.
+	messages := []ConsoleMessage{}
+	seq := ConsoleNow
+	for first := true; first || wait > 0; first = false {
+		slice := min(wait, consoleSlice)
+		wait -= slice
+		msgs, last, err := p.console(ctx, slice, seq, command)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+		seq, command = last, ""
+	}
+
+	return messages, nil
+}
+
+// ReadConsole returns the console messages after the one with sequence
+// number after, or, if after is ConsoleNow, none, along with the sequence
+// number to pass as after next time. It doesn't wait for messages, so it
+// holds an adapter pair only briefly.
+func (c *ctcapi) ReadConsole(ctx context.Context, after uint32) (
+	[]ConsoleMessage, uint32, error) {
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.release(p)
+
+	log.Trace().Msgf("reading console messages after %d", after)
+	return p.console(ctx, 0, after, "")
+}
+
+// console performs a CONSOLE command, issuing command unless it's empty, and
+// returns the console messages after seq (or, if seq is ConsoleNow, after
+// the command was issued) that CTCSERV sees within wait, and the sequence
+// number of the last message it has seen.
+func (p *pair) console(ctx context.Context, wait time.Duration, seq uint32,
+	command string) ([]ConsoleMessage, uint32, error) {
+
+	param := []byte{byte(wait / time.Second)}
+	param = binary.BigEndian.AppendUint32(param, seq)
+	param = append(param, ctc.StoE(command)...)
+
+	if err := p.sendCommand(ctx, opConsole, param); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in console()")
+		return nil, 0, err
+	}
+
+	log.Debug().Msg("console(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf(
+			"console(): couldn't perform SenseRead(): %w", err)
+	}
+	if len(data) != 8 {
+		return nil, 0, fmt.Errorf(
+			"console(): got %d bytes of data, expected 8", len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("console(): unsuccessful result code: %02x/%02x",
+			resultCode, additionalCode)
+		return nil, 0, &ResultError{Op: "CONSOLE", Code: resultCode,
+			Additional: additionalCode}
+	}
+
+	messages := []ConsoleMessage{}
+	var i int
+	for {
+		i++
+		log.Debug().Msgf("console(): reading item %d", i)
+		data, err := p.ctcdata.SenseRead(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't read item %d: %w", i, err)
+		}
+
+		if len(data) == 5 && data[0] == 0xFF {
+			// End of the messages, with the last sequence number. Done
+			return messages, binary.BigEndian.Uint32(data[1:5]), nil
+		}
+
+		if len(data) != 138 {
+			log.Error().Msgf("got length %d console message, but expected "+
+				"138", len(data))
+			// Rather than bailing out early, we will at least try to get
+			// system state back in sync by continuing to read records.
+			continue
+		}
+
+		messages = append(messages, decodeConsoleMessage(data))
+	}
+}
+
+// decodeConsoleMessage decodes a 138-byte CONSOLE entry: the sequence
+// number, time stamp and text of a message.
+func decodeConsoleMessage(data []byte) ConsoleMessage {
+	msg := ConsoleMessage{
+		Sequence: binary.BigEndian.Uint32(data[0:4]),
+		Time:     strings.TrimRight(ctc.EtoS(data[4:12]), " \x00"),
+		Text:     strings.TrimRight(ctc.EtoS(data[12:138]), " \x00"),
+	}
+	if fields := strings.Fields(msg.Text); len(fields) > 0 &&
+		messageIDRegex.MatchString(fields[0]) {
+
+		msg.MessageID = fields[0]
+	}
+	return msg
+}
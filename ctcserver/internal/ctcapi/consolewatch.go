@@ -0,0 +1,224 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultConsolePollInterval is how often a ConsoleWatcher reads the console
+// when NewConsoleWatcher is given an interval of 0.
+const DefaultConsolePollInterval = time.Second
+
+// ConsoleFilter selects console messages. A message matches if its message
+// ID begins with one of MessageIDs and one of the words of its text is one of
+// JobNames, where an empty list matches any message. MVS doesn't record which
+// job a message came from, so a job's messages are only those that name it.
+type ConsoleFilter struct {
+	MessageIDs []string
+	JobNames   []string
+}
+
+// Match reports whether msg is selected by the filter.
+func (f ConsoleFilter) Match(msg ConsoleMessage) bool {
+	if len(f.MessageIDs) > 0 {
+		found := false
+		for _, prefix := range f.MessageIDs {
+			if prefix != "" && strings.HasPrefix(msg.MessageID,
+				strings.ToUpper(prefix)) {
+
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.JobNames) > 0 {
+		words := strings.FieldsFunc(msg.Text, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '(' || r == ')'
+		})
+		for _, word := range words {
+			for _, name := range f.JobNames {
+				if strings.EqualFold(word, name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// ConsoleUpdate is sent to a ConsoleSubscription with the new messages that
+// match its filter, or with the error that reading the console failed with.
+// The same error isn't sent again until the console has been read
+// successfully.
+type ConsoleUpdate struct {
+	Messages []ConsoleMessage
+	Err      error
+}
+
+// ConsoleWatcher reads the MVS console every so often while anyone is
+// subscribed to it, and passes the new messages on to the subscribers. Each
+// read is a short command of its own, so other requests take turns with the
+// watcher for the adapter pairs rather than waiting for it to finish.
+type ConsoleWatcher struct {
+	api      CTCAPI
+	interval time.Duration
+
+	mu   sync.Mutex
+	subs map[*ConsoleSubscription]bool
+
+	// stop is closed to stop the goroutine reading the console, or nil if
+	// there isn't one.
+	stop chan struct{}
+}
+
+// ConsoleSubscription receives console messages from a ConsoleWatcher until
+// it's closed.
+type ConsoleSubscription struct {
+	// C receives the updates. If the subscriber falls behind, updates that
+	// don't fit in its buffer are dropped.
+	C <-chan ConsoleUpdate
+
+	c      chan ConsoleUpdate
+	filter ConsoleFilter
+	w      *ConsoleWatcher
+}
+
+// consoleSubscriptionBuffer is the number of updates a subscriber may fall
+// behind by before updates are dropped.
+const consoleSubscriptionBuffer = 16
+
+// NewConsoleWatcher creates a ConsoleWatcher that reads the console through
+// api every interval, or DefaultConsolePollInterval if interval is 0.
+func NewConsoleWatcher(api CTCAPI, interval time.Duration) *ConsoleWatcher {
+	if interval == 0 {
+		interval = DefaultConsolePollInterval
+	}
+	return &ConsoleWatcher{
+		api:      api,
+		interval: interval,
+		subs:     make(map[*ConsoleSubscription]bool),
+	}
+}
+
+// Subscribe starts receiving the console messages that match filter, from
+// the next time the watcher reads the console. Close the subscription when
+// done with it.
+func (w *ConsoleWatcher) Subscribe(filter ConsoleFilter) *ConsoleSubscription {
+	c := make(chan ConsoleUpdate, consoleSubscriptionBuffer)
+	sub := &ConsoleSubscription{C: c, c: c, filter: filter, w: w}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs[sub] = true
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		go w.run(w.stop)
+	}
+	return sub
+}
+
+// Close stops the subscription. The watcher stops reading the console when
+// its last subscription is closed.
+func (s *ConsoleSubscription) Close() {
+	w := s.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.subs[s] {
+		return
+	}
+	delete(w.subs, s)
+	if len(w.subs) == 0 {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+// run reads the console until stop is closed. The reads aren't canceled
+// when it is, since canceling a command part way through resets the CTC
+// link; a read in progress is left to finish and its messages discarded.
+func (w *ConsoleWatcher) run(stop chan struct{}) {
+	log.Debug().Msg("console watcher starting")
+	defer log.Debug().Msg("console watcher stopped")
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	seq := ConsoleNow
+	var lastErr string
+	for {
+		msgs, next, err := w.api.ReadConsole(context.Background(), seq)
+		if err != nil {
+			// Start again from the newest message once the console can be
+			// read, in case MVS was re-IPLed and numbers its messages from
+			// the beginning again.
+			seq = ConsoleNow
+			if err.Error() != lastErr {
+				log.Warn().Err(err).Msg("console watcher couldn't read the " +
+					"console")
+				w.publish(stop, nil, err)
+			}
+			lastErr = err.Error()
+		} else {
+			seq, lastErr = next, ""
+			if len(msgs) > 0 {
+				w.publish(stop, msgs, nil)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish sends msgs, or err, to the subscribers, unless stop has been closed
+// since the read that produced them started.
+func (w *ConsoleWatcher) publish(stop chan struct{}, msgs []ConsoleMessage,
+	err error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != stop {
+		return
+	}
+
+	for sub := range w.subs {
+		update := ConsoleUpdate{Err: err}
+		for _, msg := range msgs {
+			if sub.filter.Match(msg) {
+				update.Messages = append(update.Messages, msg)
+			}
+		}
+		if err == nil && len(update.Messages) == 0 {
+			continue
+		}
+
+		select {
+		case sub.c <- update:
+		default:
+			log.Warn().Msgf("console subscriber fell behind; dropped %d "+
+				"messages", len(update.Messages))
+		}
+	}
+}
@@ -11,48 +11,270 @@ package ctcapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"sync"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
 	"github.com/rs/zerolog/log"
 )
 
+// CTCAPI performs commands with the CTCSERV program. Each command is run on
+// an idle pair of CTC adapters; if they're all busy, the method waits its
+// turn, giving up if ctx ends first. If ctx ends while a command is in
+// progress, the CTC link is reset to resynchronize with CTCSERV and the
+// method returns a *ctc.TimeoutError.
 type CTCAPI interface {
-	GetDSList(basename string) ([]DSInfo, error)
-	GetMemberList(pdsName string) ([]string, error)
-	Read(dsn string, raw bool) ([][]byte, error)
-	Write(dsn string, data []string) error
-	Submit(jcl []string) (string, error)
-	Quit() error
+	GetDSList(ctx context.Context, basename string) ([]DSInfo, error)
+
+	// GetVTOC returns the datasets on a volume from its VTOC, cataloged or
+	// not.
+	GetVTOC(ctx context.Context, volser string) ([]DSInfo, error)
+
+	// ListVolumes returns the DASD devices known to MVS, with the volumes
+	// mounted on them and their free space.
+	ListVolumes(ctx context.Context) ([]VolumeInfo, error)
+
+	// GetMemberList, GetMemberInfo, Read and ReadStream find the dataset in
+	// the catalog, unless volume, the serial of the volume it is on, is
+	// given. The same goes for Write and WriteRaw with WriteOptions.Volume.
+	GetMemberList(ctx context.Context, pdsName, volume string) ([]string,
+		error)
+
+	// GetMemberInfo returns the members of a PDS with the information in
+	// their directory entries.
+	GetMemberInfo(ctx context.Context, pdsName, volume string) ([]MemberInfo,
+		error)
+	Read(ctx context.Context, dsn, volume string, raw bool) ([][]byte, error)
+
+	// ReadStream reads the dataset like Read, but calls fn with each record
+	// as it arrives instead of collecting them. If fn returns an error, the
+	// rest of the records are discarded and ReadStream returns that error.
+	ReadStream(ctx context.Context, dsn, volume string, raw bool,
+		fn func(record []byte) error) error
+
+	// Write replaces the records of a dataset or PDS member with lines of
+	// text, in whatever record format the dataset has. See WriteOptions.
+	Write(ctx context.Context, dsn string, data []string,
+		opts WriteOptions) (*WriteResult, error)
+
+	// WriteRaw replaces the records of a dataset or PDS member with data, as
+	// it is: split into LRECL-sized records for fixed-length records, into
+	// the records delimited by their RDWs for variable-length records, and
+	// into BLKSIZE-sized records (the last may be shorter) for undefined
+	// length records.
+	WriteRaw(ctx context.Context, dsn string, data []byte,
+		opts WriteOptions) (*WriteResult, error)
+
+	// Allocate creates and catalogs a new dataset with the given attributes.
+	// If the dataset is already cataloged, a *ResultError for which Exists
+	// is true is returned.
+	Allocate(ctx context.Context, dsn string, alloc Allocation) (*DSInfo,
+		error)
+
+	// DeleteDataset, UncatalogDataset and RenameDataset delete, uncatalog
+	// and rename datasets, and DeleteMember, RenameMember and AliasMember
+	// update PDS directories. With dryRun, they check that the operation
+	// could be done, returning the error it would fail with, but change
+	// nothing.
+	DeleteDataset(ctx context.Context, dsn string, dryRun bool) error
+	UncatalogDataset(ctx context.Context, dsn string, dryRun bool) error
+	RenameDataset(ctx context.Context, dsn, newName string,
+		dryRun bool) error
+	DeleteMember(ctx context.Context, pdsName, member string,
+		dryRun bool) error
+	RenameMember(ctx context.Context, pdsName, member, newName string,
+		dryRun bool) error
+	AliasMember(ctx context.Context, pdsName, member, alias string,
+		dryRun bool) error
+
+	// Submit submits a job to the JES2 internal reader and returns the job
+	// ID it was assigned. If JES2 rejects the job, a *JobRejectedError is
+	// returned, but only if the handshake told us CTCSERV's own job ID (see
+	// New); otherwise a rejected job seems to have been given that ID.
+	Submit(ctx context.Context, jcl []string) (string, error)
+
+	// IssueCommand issues an MVS operator command and returns the console
+	// messages written while waiting for wait afterward. CTCSERV must be
+	// APF-authorized; if it isn't, a *ResultError for which NotAuthorized is
+	// true is returned.
+	IssueCommand(ctx context.Context, command string,
+		wait time.Duration) ([]ConsoleMessage, error)
+
+	// ReadConsole returns the console messages after the one with sequence
+	// number after (none if after is ConsoleNow, which starts from the
+	// newest), and the sequence number to pass next time. Like
+	// IssueCommand, it needs CTCSERV to be APF-authorized. See
+	// ConsoleWatcher.
+	ReadConsole(ctx context.Context, after uint32) ([]ConsoleMessage, uint32,
+		error)
+
+	// GetSystemInfo returns information about the MVS system from its
+	// control blocks, and the address spaces that are active.
+	GetSystemInfo(ctx context.Context) (*SystemInfo, error)
+
+	// Quit tells every CTCSERV task to quit. It waits for any commands in
+	// progress to finish first.
+	Quit(ctx context.Context) error
+
+	// LinkState returns the state of the connection to Hercules. It is
+	// StateConnected if both the command and data adapters of at least one
+	// pair are connected.
+	LinkState() ctc.State
+
+	// Status returns the health of each adapter pair.
+	Status() []PairStatus
+
+	// Capabilities returns the version of CTCSERV and the commands it
+	// supports. Methods for commands that CTCSERV doesn't support return an
+	// error matching ErrUnsupported without sending anything over the CTC
+	// link.
+	Capabilities(ctx context.Context) (*Capabilities, error)
+}
+
+// Pair is a command and data CTC adapter pair, served by one CTCSERV task on
+// the MVS side.
+type Pair struct {
+	Cmd, Data ctc.CTC
 }
 
 type ctcapi struct {
-	ctccmd, ctcdata ctc.CTC
-	ctcMutex        sync.Mutex
+	pairs []*pair
+
+	// idle holds the pairs that aren't running a command. Waiting on it can
+	// be abandoned when a context ends.
+	idle chan *pair
 }
 
+// DefaultTimeout is the time allowed for each CCW exchange with CTCSERV when
+// New is given a timeout of 0.
+const DefaultTimeout = 30 * time.Second
+
 type opcode byte
 
+// The CTCSERV command opcodes. 0x07 to 0x09 are set aside for the job status
+// commands in the TODO list of the README.
 const (
-	opDSList  opcode = 0x01
-	opMbrList opcode = 0x02
-	opRead    opcode = 0x03
-	opSubmit  opcode = 0x04
-	opWrite   opcode = 0x05
-	opQuit    opcode = 0xFF
+	opDSList   opcode = 0x01
+	opMbrList  opcode = 0x02
+	opRead     opcode = 0x03
+	opSubmit   opcode = 0x04
+	opWrite    opcode = 0x05
+	opCaps     opcode = 0x06
+	opIdentify opcode = 0x0A
+	opAllocate opcode = 0x0B
+	opDSMaint  opcode = 0x0C
+	opMbrMaint opcode = 0x0D
+	opVTOC     opcode = 0x0E
+	opVolList  opcode = 0x0F
+	opConsole  opcode = 0x10
+	opSysInfo  opcode = 0x11
+	opQuit     opcode = 0xFF
 )
 
-func New(ctccmd, ctcdata ctc.CTC) CTCAPI {
+// New creates a CTCAPI using the provided pairs of command and data CTC
+// adapters, of which there must be at least one. Each CCW exchange with
+// CTCSERV must complete within timeout, or DefaultTimeout if timeout is 0.
+//
+// If handshake is true, CTCSERV is asked for its capabilities with the CAPS
+// command the first time each pair is used. Otherwise it's assumed to be a
+// CTCSERV from before the CAPS command was added, which supports only the
+// original commands: one that doesn't understand CAPS never responds to it,
+// and the link has to be reset to recover, which Hercules 3.13 can't
+// reconnect after.
+func New(pairs []Pair, timeout time.Duration, handshake bool) CTCAPI {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
 	c := ctcapi{
-		ctccmd:  ctccmd,
-		ctcdata: ctcdata,
+		idle: make(chan *pair, len(pairs)),
+	}
+	for i, adapters := range pairs {
+		p := &pair{index: i, probe: handshake}
+		p.ctccmd = &link{CTC: adapters.Cmd, partner: adapters.Data,
+			timeout: timeout, pair: p}
+		p.ctcdata = &link{CTC: adapters.Data, partner: adapters.Cmd,
+			timeout: timeout, pair: p}
+		c.pairs = append(c.pairs, p)
+		c.idle <- p
 	}
 
 	return &c
 }
 
-func (c *ctcapi) sendCommand(op opcode, param []byte) error {
+func (c *ctcapi) LinkState() ctc.State {
+	state := ctc.StateDisconnected
+	for _, p := range c.pairs {
+		state = max(state, p.state())
+	}
+	return state
+}
+
+// link is one of the pair of CTC adapters. If the connection on one of them
+// is lost part way through a command, the CTCSERV program may have already
+// sent (or be about to send) data on the other, which we would misinterpret
+// as the response to the next command. To get both sides back in sync, we
+// reset the partner adapter whenever that happens.
+//
+// link also bounds each CCW exchange by timeout, so that a hung CTCSERV
+// can't hold up the API forever, and records failures in the pair's health.
+type link struct {
+	ctc.CTC
+	partner ctc.CTC
+	timeout time.Duration
+	pair    *pair
+}
+
+func (l *link) checkLost(err error) error {
+	if err != nil {
+		l.pair.failed(err)
+	}
+	if errors.Is(err, ctc.ErrNotConnected) {
+		l.partner.Reset()
+	}
+	return err
+}
+
+func (l *link) ControlWrite(ctx context.Context, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.checkLost(l.CTC.ControlWrite(ctx, data))
+}
+
+func (l *link) NakedWrite(ctx context.Context, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	return l.checkLost(l.CTC.NakedWrite(ctx, data))
+}
+
+func (l *link) SenseRead(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	data, err := l.CTC.SenseRead(ctx)
+	return data, l.checkLost(err)
+}
+
+func (p *pair) sendCommand(ctx context.Context, op opcode,
+	param []byte) error {
+
+	// Don't start a command unless both adapters are ready; a command
+	// half-sent on one adapter would leave CTCSERV waiting on the other.
+	if state := p.state(); state != ctc.StateConnected {
+		return fmt.Errorf("%w: CTC link is %s", ctc.ErrNotConnected, state)
+	}
+
+	// CTCSERV doesn't respond to opcodes it doesn't know, which would leave
+	// us waiting for a response that never comes.
+	if caps := p.capabilities(); op != opCaps && caps != nil &&
+		!caps.supports(op) {
+
+		return fmt.Errorf("%w: CTCSERV version %d doesn't support the %s "+
+			"command", ErrUnsupported, caps.Version, op)
+	}
+
 	// Build the command buffer -- pad the parameter to 255 length w/ EBCDIC
 	// spaces
 	var buf bytes.Buffer
@@ -63,8 +285,8 @@ func (c *ctcapi) sendCommand(op opcode, param []byte) error {
 	buf.Write(parampadded)
 
 	// Send it with a CONTROL+WRITE
-	log.Debug().Msgf("Sending opcode %02x with param %x")
-	if err := c.ctccmd.ControlWrite(buf.Bytes()); err != nil {
+	log.Debug().Msgf("Sending opcode %02x with param %x", op, param)
+	if err := p.ctccmd.ControlWrite(ctx, buf.Bytes()); err != nil {
 		return err
 	}
 
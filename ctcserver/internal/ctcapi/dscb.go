@@ -0,0 +1,116 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Offsets of the format-1 DSCB fields in the 96 bytes returned by OBTAIN,
+// which begin at DS1FMTID (offset 0x2C of the DSCB). See
+// SYS1.AMODGEN(IECSDSL1) for the field definitions.
+const (
+	ds1CREDT = 0x35 - 0x2C // creation date
+	ds1EXPDT = 0x38 - 0x2C // expiration date
+	ds1NOEPV = 0x3B - 0x2C // number of extents
+	ds1REFD  = 0x4B - 0x2C // last referenced date
+	ds1KEYL  = 0x5A - 0x2C // key length
+	ds1DSIND = 0x5D - 0x2C // dataset indicators
+	ds1SCALO = 0x5E - 0x2C // secondary allocation
+	ds1LSTAR = 0x62 - 0x2C // TTR of the last block written
+	ds1EXT1  = 0x69 - 0x2C // first extent description
+)
+
+// Bits of DS1DSIND.
+const (
+	ds1IND40 = 0x40 // defined to RACF
+	ds1IND10 = 0x10 // password protected
+	ds1IND04 = 0x04 // password needed to write only, if ds1IND10 is on
+)
+
+// decodeDSCB fills in the attributes of dsinfo that DSLIST doesn't decode
+// itself from the format-1 DSCB.
+func decodeDSCB(dsinfo *DSInfo, dscb []byte) {
+	dsinfo.KeyLength = int(dscb[ds1KEYL])
+	dsinfo.Created = dscbDate(dscb[ds1CREDT : ds1CREDT+3])
+	dsinfo.Expires = dscbDate(dscb[ds1EXPDT : ds1EXPDT+3])
+	dsinfo.LastReferenced = dscbDate(dscb[ds1REFD : ds1REFD+3])
+	dsinfo.Extents = int(dscb[ds1NOEPV])
+
+	// The high-order two bits of the first byte of DS1SCALO are the
+	// allocation unit; the other three bytes are the secondary quantity.
+	switch dscb[ds1SCALO] & 0xC0 {
+	case 0xC0:
+		dsinfo.SpaceUnits = "CYL"
+	case 0x80:
+		dsinfo.SpaceUnits = "TRK"
+	case 0x40:
+		dsinfo.SpaceUnits = "BLK"
+	default:
+		dsinfo.SpaceUnits = "ABSTR"
+	}
+	dsinfo.SecondaryQuantity = int(binary.BigEndian.Uint32(
+		dscb[ds1SCALO:ds1SCALO+4]) & 0xFFFFFF)
+	dsinfo.PrimaryQuantity = primaryQuantity(dsinfo.SpaceUnits,
+		dscb[ds1EXT1:ds1EXT1+10])
+
+	// DS1LSTAR is zero if nothing has been written; otherwise TT is the
+	// relative track the last block was written to.
+	tt := int(binary.BigEndian.Uint16(dscb[ds1LSTAR : ds1LSTAR+2]))
+	if tt != 0 || dscb[ds1LSTAR+2] != 0 {
+		dsinfo.UsedTracks = tt + 1
+	}
+
+	ind := dscb[ds1DSIND]
+	dsinfo.RACFProtected = ind&ds1IND40 != 0
+	switch {
+	case ind&ds1IND10 != 0 && ind&ds1IND04 != 0:
+		dsinfo.Password = "write"
+	case ind&ds1IND10 != 0:
+		dsinfo.Password = "read"
+	}
+}
+
+// primaryQuantity works out the primary allocation from the size of the
+// first extent, given as its type, sequence number, and lower and upper
+// CCHH. Without the number of tracks per cylinder, that's only possible for
+// cylinder allocations and track allocations within one cylinder.
+func primaryQuantity(units string, extent []byte) *int {
+	if extent[0] == 0 {
+		return nil
+	}
+	lcyl := int(binary.BigEndian.Uint16(extent[2:4]))
+	lhead := int(binary.BigEndian.Uint16(extent[4:6]))
+	ucyl := int(binary.BigEndian.Uint16(extent[6:8]))
+	uhead := int(binary.BigEndian.Uint16(extent[8:10]))
+
+	var n int
+	switch {
+	case units == "CYL":
+		n = ucyl - lcyl + 1
+	case units == "TRK" && lcyl == ucyl:
+		n = uhead - lhead + 1
+	default:
+		return nil
+	}
+	return &n
+}
+
+// dscbDate decodes a 3-byte DSCB date, the year less 1900 followed by the
+// halfword day of the year, into YYYY-MM-DD form. Zero means no date.
+func dscbDate(d []byte) string {
+	day := int(binary.BigEndian.Uint16(d[1:3]))
+	if day == 0 {
+		return ""
+	}
+	return time.Date(1900+int(d[0]), time.January, day, 0, 0, 0, 0,
+		time.UTC).Format(time.DateOnly)
+}
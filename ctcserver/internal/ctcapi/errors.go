@@ -0,0 +1,380 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidInput is matched, using errors.Is, by the errors returned when a
+// request is rejected before being sent to CTCSERV because its parameters
+// (such as a dataset name) are invalid.
+var ErrInvalidInput = errors.New("invalid input")
+
+// ErrUnsupported is matched, using errors.Is, by the errors returned when a
+// request needs a command that the CTCSERV program on MVS doesn't support,
+// such as when it is an older version than ctcserver.
+var ErrUnsupported = errors.New("command not supported by CTCSERV")
+
+// ErrBusy is matched, using errors.Is, by the error returned when a request's
+// context ends while it's waiting for a CTC adapter pair to become free. The
+// error also matches the context's error.
+var ErrBusy = errors.New("all CTC adapter pairs are busy")
+
+// JobRejectedError is returned by Submit when JES2 didn't accept the job,
+// for example because it has no valid JOB statement. The internal reader
+// doesn't report an error in that case; instead it hands back the job ID of
+// CTCSERV itself, which we learn with the IDENTIFY command. That's only sent
+// when the handshake is enabled and CTCSERV supports it, so without it
+// Submit can't detect a rejected job.
+type JobRejectedError struct {
+	// ServerJobID is the job ID of CTCSERV, returned in place of a new one.
+	ServerJobID string
+}
+
+func (e *JobRejectedError) Error() string {
+	return fmt.Sprintf("job was rejected by JES2 (the internal reader "+
+		"returned CTCSERV's own job ID %s)", e.ServerJobID)
+}
+
+// inputError is the type of error returned by invalidInput.
+type inputError struct {
+	msg string
+}
+
+func (e *inputError) Error() string {
+	return e.msg
+}
+
+func (e *inputError) Is(target error) bool {
+	return target == ErrInvalidInput
+}
+
+// invalidInput formats an error message that matches ErrInvalidInput.
+func invalidInput(format string, a ...any) error {
+	return &inputError{msg: fmt.Sprintf(format, a...)}
+}
+
+// Result codes returned by the MBRLIST, READ and WRITE commands. DSLIST
+// returns the catalog search return code directly, and SUBMIT has its own
+// result codes; see ResultError.Description.
+const (
+	ResultBadLength uint32 = 0xF0 // parameter is the wrong length
+	ResultLocate    uint32 = 0xF1 // LOCATE or OBTAIN failed
+	ResultFormat    uint32 = 0xF2 // unsupported DSORG or RECFM
+	ResultDynalloc  uint32 = 0xF3 // dynamic allocation failed
+	ResultNoMember  uint32 = 0xF4 // BLDL failed (READ only)
+	ResultCTCRead   uint32 = 0xF5 // CTC READ failed (WRITE only)
+	ResultPut       uint32 = 0xF6 // PUT failed (WRITE only)
+	ResultCTCSense  uint32 = 0xF7 // CTC SENSE failed (WRITE only)
+)
+
+// ResultExists is returned by the ALLOC command, in addition to
+// ResultBadLength, ResultLocate and ResultDynalloc, when the dataset is
+// already cataloged, and by the DSMAINT and MBRMAINT commands when the new
+// name for a dataset or member is already in use.
+const ResultExists uint32 = 0xFB
+
+// Result codes returned by the DSMAINT and MBRMAINT commands, in addition to
+// ResultBadLength, ResultLocate, ResultDynalloc and ResultExists. MBRMAINT
+// also returns ResultFormat and ResultNoMember.
+const (
+	ResultRename uint32 = 0xFC // RENAME failed (DSMAINT only)
+	ResultUpdate uint32 = 0xFD // CATALOG (DSMAINT) or STOW (MBRMAINT) failed
+)
+
+// ResultNotAuthorized is returned by the CONSOLE command, in addition to
+// ResultBadLength, when CTCSERV isn't running APF-authorized.
+const ResultNotAuthorized uint32 = 0xEF
+
+// obtainFlag is added to an OBTAIN return code by CTCSERV to distinguish it
+// from a LOCATE return code in the additional code of ResultLocate.
+const obtainFlag = 0x100
+
+// ResultError is the error returned when CTCSERV reports that a command was
+// unsuccessful. Use errors.As to retrieve it and examine the codes.
+type ResultError struct {
+	// Op is the name of the CTCSERV command, e.g. "READ".
+	Op string
+
+	// Code is the result code. For DSLIST, this is the return code of the
+	// catalog search.
+	Code uint32
+
+	// Additional is the additional code returned with some result codes,
+	// typically the return or reason code of the MVS service that failed.
+	Additional uint32
+
+	// Record is the 1-based number of the record that SUBMIT or WRITE was
+	// sending when the error occurred, or 0 if it didn't occur while sending
+	// a record.
+	Record int
+}
+
+func (e *ResultError) Error() string {
+	msg := fmt.Sprintf("%s: %s (result code %02x/%02x)", e.Op,
+		e.Description(), e.Code, e.Additional)
+	if e.Record > 0 {
+		msg += fmt.Sprintf(" after record %d", e.Record)
+	}
+	return msg
+}
+
+// NotCataloged reports whether the command failed because the dataset isn't
+// in the catalog.
+func (e *ResultError) NotCataloged() bool {
+	if e.Op == "DSLIST" {
+		return e.Code == 8
+	}
+	return e.Op != "SUBMIT" && e.Code == ResultLocate && e.Additional == 8
+}
+
+// NotOnVolume reports whether the command failed because the dataset isn't
+// in the VTOC of the volume it was looked for on.
+func (e *ResultError) NotOnVolume() bool {
+	return e.Code == ResultLocate && e.Additional == obtainFlag+8
+}
+
+// VolumeNotMounted reports whether the command failed because the volume
+// the dataset was looked for on isn't mounted.
+func (e *ResultError) VolumeNotMounted() bool {
+	return e.Code == ResultLocate && e.Additional == obtainFlag+4
+}
+
+// InUse reports whether the command failed because dynamic allocation
+// couldn't get the dataset because another job is using it.
+func (e *ResultError) InUse() bool {
+	return e.Op != "DSLIST" && e.Op != "SUBMIT" &&
+		e.Code == ResultDynalloc && e.Additional>>16 == 0x0210
+}
+
+// Exists reports whether ALLOC failed because the dataset is already
+// cataloged, or DSMAINT or MBRMAINT failed because the new name is already
+// in use.
+func (e *ResultError) Exists() bool {
+	switch e.Op {
+	case "ALLOC", "DSMAINT", "MBRMAINT":
+		return e.Code == ResultExists
+	}
+	return false
+}
+
+// NotAuthorized reports whether CONSOLE failed because CTCSERV isn't
+// APF-authorized, which it must be to issue operator commands.
+func (e *ResultError) NotAuthorized() bool {
+	return e.Op == "CONSOLE" && e.Code == ResultNotAuthorized
+}
+
+// MemberNotFound reports whether READ or MBRMAINT failed because the
+// requested member isn't in the PDS directory.
+func (e *ResultError) MemberNotFound() bool {
+	return (e.Op == "READ" || e.Op == "MBRMAINT") &&
+		e.Code == ResultNoMember && e.Additional != 8
+}
+
+// Description returns a human-readable description of the failure.
+func (e *ResultError) Description() string {
+	switch e.Op {
+	case "DSLIST":
+		return "catalog search failed: " + locateDescription(e.Code)
+	case "SUBMIT":
+		return submitDescription(e.Code)
+	}
+
+	switch e.Code {
+	case ResultBadLength:
+		return "invalid parameter length"
+	case ResultLocate:
+		if e.Additional >= obtainFlag {
+			return "VTOC OBTAIN failed: " +
+				obtainDescription(e.Additional-obtainFlag)
+		}
+		return "catalog LOCATE failed: " + locateDescription(e.Additional)
+	case ResultFormat:
+		if e.Op == "MBRLIST" || e.Op == "MBRMAINT" {
+			return "dataset is not partitioned"
+		}
+		return "dataset organization or record format is not supported"
+	case ResultDynalloc:
+		return "dynamic allocation failed: " +
+			dynallocDescription(e.Additional)
+	case ResultNoMember:
+		return "BLDL failed: " + bldlDescription(e.Additional)
+	case ResultCTCRead:
+		return "CTCSERV couldn't read the record from the CTC adapter"
+	case ResultPut:
+		return "PUT to the dataset failed"
+	case ResultCTCSense:
+		return "CTCSERV couldn't sense the CTC adapter"
+	case ResultExists:
+		switch e.Op {
+		case "DSMAINT":
+			return "the new dataset name is already cataloged"
+		case "MBRMAINT":
+			return "a member with the new name already exists"
+		}
+		return "the dataset is already cataloged"
+	case ResultNotAuthorized:
+		return "CTCSERV isn't APF-authorized"
+	case ResultRename:
+		return "RENAME failed: " + renameDescription(e.Additional)
+	case ResultUpdate:
+		if e.Op == "MBRMAINT" {
+			return "STOW failed: " + stowDescription(e.Additional)
+		}
+		return "CATALOG failed: " + catalogDescription(e.Additional)
+	}
+	return "unknown result code"
+}
+
+// See OS/VS2 MVS Data Management Macro Instructions, LOCATE.
+func locateDescription(rc uint32) string {
+	switch rc {
+	case 4:
+		return "the catalog does not exist or could not be opened"
+	case 8:
+		return "the dataset is not cataloged"
+	case 12:
+		return "an index or generation data group was found instead of " +
+			"a dataset"
+	case 16:
+		return "a dataset exists at a higher level of the name"
+	case 20:
+		return "the dataset name is syntactically invalid"
+	case 24:
+		return "permanent I/O error in the catalog"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// See OS/VS2 System Programming Library: Data Management, OBTAIN.
+func obtainDescription(rc uint32) string {
+	switch rc {
+	case 4:
+		return "the volume is not mounted"
+	case 8:
+		return "the format-1 DSCB was not found in the VTOC"
+	case 12:
+		return "permanent I/O error or invalid DSCB in the VTOC"
+	case 16:
+		return "invalid work area pointer"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// See OS/VS2 MVS Data Management Macro Instructions, BLDL.
+func bldlDescription(rc uint32) string {
+	switch rc {
+	case 0, 4: // versions of CTCSERV before BLDL codes were returned send 0
+		return "the member does not exist"
+	case 8:
+		return "permanent I/O error or insufficient storage"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// See OS/VS2 System Programming Library: Data Management, RENAME.
+func renameDescription(rc uint32) string {
+	switch rc {
+	case 4:
+		return "no volume containing the dataset is mounted"
+	case 8:
+		return "an unusual condition was found on one or more volumes"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// See OS/VS2 System Programming Library: Data Management, CATALOG.
+func catalogDescription(rc uint32) string {
+	switch rc {
+	case 4:
+		return "the catalog volume is not mounted"
+	case 8:
+		return "the name is already cataloged, or isn't cataloged"
+	case 20:
+		return "there is no space left in the catalog"
+	case 28:
+		return "permanent I/O error"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// See OS/VS2 MVS Data Management Macro Instructions, STOW.
+func stowDescription(rc uint32) string {
+	switch rc {
+	case 4:
+		return "the new name already exists"
+	case 8:
+		return "the member does not exist"
+	case 12:
+		return "the directory is full"
+	case 16:
+		return "permanent I/O error"
+	case 24:
+		return "insufficient storage"
+	}
+	return fmt.Sprintf("return code %d", rc)
+}
+
+// dynallocDescription decodes the S99ERROR reason code (high halfword) and
+// S99INFO information code (low halfword) returned for a failed DYNALLOC.
+// See OS/VS2 System Programming Library: Job Management, Dynamic Allocation.
+func dynallocDescription(codes uint32) string {
+	if codes == 0 {
+		// Versions of CTCSERV before these codes were returned send 0.
+		return "no reason code available"
+	}
+
+	reason := codes >> 16
+	info := codes & 0xFFFF
+
+	var desc string
+	switch reason {
+	case 0x0210:
+		desc = "the dataset is in use by another job"
+	case 0x0218:
+		desc = "the volume is not mounted"
+	case 0x021C:
+		desc = "the unit name is not defined"
+	case 0x0220:
+		desc = "the volume is in use by another job"
+	case 0x1708:
+		desc = "the dataset is not cataloged"
+	case 0x4704:
+		desc = "a dataset of the same name is already on the volume"
+	case 0x4708:
+		desc = "the VTOC is full"
+	case 0x4714:
+		desc = "the requested space is not available on the volume"
+	default:
+		desc = "see the S99ERROR code"
+	}
+	return fmt.Sprintf("%s (S99ERROR %04X, S99INFO %04X)", desc, reason,
+		info)
+}
+
+func submitDescription(code uint32) string {
+	switch code {
+	case 0xF0:
+		return "invalid record count"
+	case 0xF1:
+		return "dynamic allocation of the internal reader failed"
+	case 0xF2:
+		return "GENCB of the internal reader ACB failed"
+	case 0xF3:
+		return "GENCB of the internal reader RPL failed"
+	case 0xF4:
+		return "PUT to the internal reader failed"
+	case 0xF5:
+		return "ENDREQ to the internal reader failed"
+	}
+	return "unknown result code"
+}
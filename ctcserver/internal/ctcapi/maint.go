@@ -0,0 +1,192 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Functions of the DSMAINT and MBRMAINT commands.
+const (
+	dsmaintDelete    byte = 0x01
+	dsmaintUncatalog byte = 0x02
+	dsmaintRename    byte = 0x03
+
+	mbrmaintDelete byte = 0x01
+	mbrmaintRename byte = 0x02
+	mbrmaintAlias  byte = 0x03
+)
+
+// maintDryRun is the flag asking DSMAINT or MBRMAINT to make all its checks
+// but change nothing.
+const maintDryRun byte = 0x80
+
+var memberRegex = regexp.MustCompile(`^[a-zA-Z$#@-][a-zA-Z0-9$#@-]{0,7}$`)
+
+// DeleteDataset deletes a dataset from its volumes and uncatalogs it. With
+// dryRun, it only checks that the dataset is cataloged and not in use.
+func (c *ctcapi) DeleteDataset(ctx context.Context, dsn string,
+	dryRun bool) error {
+
+	return c.dsmaint(ctx, dsmaintDelete, dsn, "", dryRun)
+}
+
+// UncatalogDataset removes a dataset from the catalog, leaving it on its
+// volumes. With dryRun, it only checks that the dataset is cataloged and not
+// in use.
+func (c *ctcapi) UncatalogDataset(ctx context.Context, dsn string,
+	dryRun bool) error {
+
+	return c.dsmaint(ctx, dsmaintUncatalog, dsn, "", dryRun)
+}
+
+// RenameDataset renames a dataset on its volumes and in the catalog. With
+// dryRun, it only checks that the dataset is cataloged and not in use, and
+// that the new name isn't cataloged.
+func (c *ctcapi) RenameDataset(ctx context.Context, dsn, newName string,
+	dryRun bool) error {
+
+	if err := checkDSName(newName); err != nil {
+		return err
+	}
+	if strings.EqualFold(dsn, newName) {
+		return invalidInput("the new dataset name is the same as the old")
+	}
+	return c.dsmaint(ctx, dsmaintRename, dsn, newName, dryRun)
+}
+
+// DeleteMember deletes a member, or an alias, from a PDS directory. With
+// dryRun, it only checks that the member exists.
+func (c *ctcapi) DeleteMember(ctx context.Context, pdsName, member string,
+	dryRun bool) error {
+
+	return c.mbrmaint(ctx, mbrmaintDelete, pdsName, member, "", dryRun)
+}
+
+// RenameMember renames a member of a PDS. With dryRun, it only checks that
+// the member exists and the new name doesn't.
+func (c *ctcapi) RenameMember(ctx context.Context, pdsName, member,
+	newName string, dryRun bool) error {
+
+	return c.mbrmaint(ctx, mbrmaintRename, pdsName, member, newName, dryRun)
+}
+
+// AliasMember adds an alias for a member of a PDS. With dryRun, it only
+// checks that the member exists and the alias doesn't.
+func (c *ctcapi) AliasMember(ctx context.Context, pdsName, member,
+	alias string, dryRun bool) error {
+
+	return c.mbrmaint(ctx, mbrmaintAlias, pdsName, member, alias, dryRun)
+}
+
+// dsmaint validates the dataset name and sends the 90-byte DSMAINT
+// parameter: the function, flags, dataset name and new dataset name.
+func (c *ctcapi) dsmaint(ctx context.Context, function byte, dsn,
+	newName string, dryRun bool) error {
+
+	if err := checkDSName(dsn); err != nil {
+		return err
+	}
+
+	param := []byte{function, maintFlags(dryRun)}
+	param = append(param, padEbcdic(strings.ToUpper(dsn), 44)...)
+	param = append(param, padEbcdic(strings.ToUpper(newName), 44)...)
+	return c.maint(ctx, opDSMaint, "DSMAINT", param)
+}
+
+// mbrmaint validates the names and sends the 62-byte MBRMAINT parameter:
+// the function, flags, dataset name, member name and new member name.
+func (c *ctcapi) mbrmaint(ctx context.Context, function byte, pdsName,
+	member, newName string, dryRun bool) error {
+
+	if err := checkDSName(pdsName); err != nil {
+		return err
+	}
+	if !memberRegex.MatchString(member) {
+		return invalidInput("member name is invalid")
+	}
+	if function != mbrmaintDelete {
+		if !memberRegex.MatchString(newName) {
+			return invalidInput("new member name is invalid")
+		}
+		if strings.EqualFold(member, newName) {
+			return invalidInput("the new member name is the same as the old")
+		}
+	}
+
+	param := []byte{function, maintFlags(dryRun)}
+	param = append(param, padEbcdic(strings.ToUpper(pdsName), 44)...)
+	param = append(param, padEbcdic(strings.ToUpper(member), 8)...)
+	param = append(param, padEbcdic(strings.ToUpper(newName), 8)...)
+	return c.maint(ctx, opMbrMaint, "MBRMAINT", param)
+}
+
+// maint sends a DSMAINT or MBRMAINT command and reads its response, which
+// is only the result and additional codes.
+func (c *ctcapi) maint(ctx context.Context, op opcode, name string,
+	param []byte) error {
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release(p)
+
+	log.Debug().Hex("param", param).Msgf("sending %s command", name)
+
+	if err := p.sendCommand(ctx, op, param); err != nil {
+		log.Error().Err(err).Msgf("sendCommand() error in %s", name)
+		return err
+	}
+
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't perform SenseRead(): %w", name, err)
+	}
+	if len(data) != 8 {
+		return fmt.Errorf("%s: got %d bytes in response but expected 8",
+			name, len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("%s: unsuccessful result code: %02x/%02x", name,
+			resultCode, additionalCode)
+		return &ResultError{Op: name, Code: resultCode,
+			Additional: additionalCode}
+	}
+	return nil
+}
+
+// checkDSName checks that dsn is a valid dataset name without a member.
+func checkDSName(dsn string) error {
+	if len(dsn) > 44 {
+		return invalidInput("dataset name too long; got %d characters "+
+			"but needs to be 44 or fewer", len(dsn))
+	}
+	if !dsnameRegex.MatchString(dsn) {
+		return invalidInput("dataset name is invalid")
+	}
+	return nil
+}
+
+func maintFlags(dryRun bool) byte {
+	if dryRun {
+		return maintDryRun
+	}
+	return 0
+}
@@ -0,0 +1,276 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// MemberInfo describes a PDS member from its directory entry.
+type MemberInfo struct {
+	Name string `json:"name"`
+
+	// TTR is the relative track and record of the start of the member, in
+	// hex. It's empty if CTCSERV is too old to send it.
+	TTR string `json:"ttr,omitempty"`
+
+	// Alias is true if the entry is an alias of another member.
+	Alias bool `json:"alias"`
+
+	// UserData is the user data of the directory entry, in hex.
+	UserData string `json:"user_data,omitempty"`
+
+	// Stats are the ISPF statistics of the member, if it has them. RPF and
+	// other editors on MVS 3.8 keep statistics in the same format.
+	Stats *ISPFStats `json:"ispf_stats,omitempty"`
+
+	// LoadModule holds the attributes of a load module.
+	LoadModule *LoadModuleInfo `json:"load_module,omitempty"`
+}
+
+// ISPFStats are the statistics ISPF keeps in the user data of a member's
+// directory entry.
+type ISPFStats struct {
+	// Version is the version and modification level, as VV.MM.
+	Version string `json:"version"`
+
+	// Created is in YYYY-MM-DD form, and Changed in YYYY-MM-DDTHH:MM:SS
+	// form, in the time zone of the system that changed the member.
+	Created string `json:"created"`
+	Changed string `json:"changed"`
+
+	Lines         int    `json:"lines"`
+	InitialLines  int    `json:"initial_lines"`
+	ModifiedLines int    `json:"modified_lines"`
+	User          string `json:"user"`
+}
+
+// LoadModuleInfo holds the attributes of a load module from its directory
+// entry. See the PDS2 fields in SYS1.AMODGEN(IHAPDS).
+type LoadModuleInfo struct {
+	// Size is the main storage the module needs, and EntryPoint the offset
+	// of its entry point, in bytes.
+	Size       int `json:"size"`
+	EntryPoint int `json:"entry_point"`
+
+	// Attributes are the linkage editor attributes, out of RENT, REUS, REFR,
+	// OVLY, SCTR, TEST, OL and NE.
+	Attributes []string `json:"attributes"`
+
+	// Executable is false if the linkage editor found errors that make the
+	// module unusable.
+	Executable bool `json:"executable"`
+
+	// AuthorizationCode is the APF authorization code, if the entry has one.
+	AuthorizationCode *int `json:"ac,omitempty"`
+
+	// AliasOf is the name of the member an alias refers to.
+	AliasOf string `json:"alias_of,omitempty"`
+}
+
+// GetMemberList returns the names of the members of a PDS.
+func (c *ctcapi) GetMemberList(ctx context.Context,
+	pdsName, volume string) ([]string, error) {
+
+	members, err := c.GetMemberInfo(ctx, pdsName, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	return names, nil
+}
+
+// Bits of the indicator byte of a directory entry, and of the PDS2ATR1,
+// PDS2ATR2 and PDS2FTB1 fields of a load module's user data.
+const (
+	pdsAlias   = 0x80 // entry is an alias
+	pdsTTRs    = 0x60 // number of TTRs in the user data
+	pdsUserLen = 0x1F // halfwords of user data
+
+	pds2RENT = 0x80
+	pds2REUS = 0x40
+	pds2OVLY = 0x20
+	pds2TEST = 0x10
+	pds2OL   = 0x08
+	pds2SCTR = 0x04
+	pds2EXEC = 0x02
+
+	pds2NREP = 0x08
+	pds2REFR = 0x01
+
+	pds2SSI  = 0x80
+	pds2APFL = 0x40
+)
+
+// decodeMember decodes a member entry sent by MBRLIST: the 8-byte name, the
+// indicator byte, 62 bytes of user data, and (from newer versions of
+// CTCSERV) the 3-byte TTR.
+func decodeMember(data []byte) MemberInfo {
+	member := MemberInfo{
+		Name: strings.TrimRight(ctc.EtoS(data[0:8]), " "),
+	}
+	if len(data) < 71 {
+		return member
+	}
+	if len(data) >= 74 {
+		member.TTR = fmt.Sprintf("%06X", data[71:74])
+	}
+
+	indicator := data[8]
+	udata := data[9 : 9+2*int(indicator&pdsUserLen)]
+	member.Alias = indicator&pdsAlias != 0
+	if len(udata) > 0 {
+		member.UserData = fmt.Sprintf("%X", udata)
+	}
+
+	// There's nothing to say what the user data is, so we go by its shape.
+	// Load modules have TTRs in their user data; ISPF statistics don't.
+	if indicator&pdsTTRs == 0 {
+		member.Stats = decodeISPFStats(udata)
+	} else if len(udata) >= 22 {
+		member.LoadModule = decodeLoadModule(udata, member.Alias)
+	}
+	return member
+}
+
+// decodeISPFStats decodes ISPF statistics, returning nil if udata doesn't
+// hold them.
+func decodeISPFStats(udata []byte) *ISPFStats {
+	if len(udata) != 30 && len(udata) != 40 {
+		return nil
+	}
+
+	created, ok := packedDate(udata[4:8])
+	if !ok {
+		return nil
+	}
+	changed, ok := packedDate(udata[8:12])
+	if !ok {
+		return nil
+	}
+	hh, ok1 := packed(udata[12])
+	mm, ok2 := packed(udata[13])
+	ss, ok3 := packed(udata[3])
+	if !ok1 || !ok2 || !ok3 {
+		return nil
+	}
+	changed = changed.Add(time.Duration(hh)*time.Hour +
+		time.Duration(mm)*time.Minute + time.Duration(ss)*time.Second)
+
+	stats := &ISPFStats{
+		Version:       fmt.Sprintf("%02d.%02d", udata[0], udata[1]),
+		Created:       created.Format(time.DateOnly),
+		Changed:       changed.Format("2006-01-02T15:04:05"),
+		Lines:         int(binary.BigEndian.Uint16(udata[14:16])),
+		InitialLines:  int(binary.BigEndian.Uint16(udata[16:18])),
+		ModifiedLines: int(binary.BigEndian.Uint16(udata[18:20])),
+		User:          strings.TrimRight(ctc.EtoS(udata[20:28]), " \x00"),
+	}
+
+	// Extended statistics carry line counts too large for a halfword.
+	if len(udata) == 40 && udata[2]&0x20 != 0 {
+		stats.Lines = int(binary.BigEndian.Uint32(udata[28:32]))
+		stats.InitialLines = int(binary.BigEndian.Uint32(udata[32:36]))
+		stats.ModifiedLines = int(binary.BigEndian.Uint32(udata[36:40]))
+	}
+	return stats
+}
+
+// packedDate decodes a packed decimal date of the form 0CYYDDDF, where C is
+// the century (0 for 19xx, 1 for 20xx).
+func packedDate(d []byte) (time.Time, bool) {
+	if d[0]&0xF0 != 0 || d[3]&0x0F != 0x0F {
+		return time.Time{}, false
+	}
+	yy, ok1 := packed(d[1])
+	ddd, ok2 := packed(d[2])
+	d3 := int(d[3] >> 4)
+	if !ok1 || !ok2 || d3 > 9 || d[0] > 1 {
+		return time.Time{}, false
+	}
+	day := ddd*10 + d3
+	if day < 1 || day > 366 {
+		return time.Time{}, false
+	}
+	year := 1900 + 100*int(d[0]) + yy
+	return time.Date(year, time.January, day, 0, 0, 0, 0, time.UTC), true
+}
+
+// packed decodes a byte of two packed decimal digits.
+func packed(b byte) (int, bool) {
+	hi, lo := int(b>>4), int(b&0x0F)
+	if hi > 9 || lo > 9 {
+		return 0, false
+	}
+	return hi*10 + lo, true
+}
+
+// decodeLoadModule decodes the user data of a load module's directory
+// entry, which is at least the 22 bytes of the basic section.
+func decodeLoadModule(udata []byte, alias bool) *LoadModuleInfo {
+	atr1, atr2, ftb1 := udata[8], udata[9], udata[18]
+	lm := &LoadModuleInfo{
+		Size:       int(binary.BigEndian.Uint32(udata[9:13]) & 0xFFFFFF),
+		EntryPoint: int(binary.BigEndian.Uint32(udata[14:18]) & 0xFFFFFF),
+		Attributes: []string{},
+		Executable: atr1&pds2EXEC != 0,
+	}
+
+	for _, attr := range []struct {
+		set  bool
+		name string
+	}{
+		{atr1&pds2RENT != 0, "RENT"},
+		{atr1&pds2REUS != 0, "REUS"},
+		{atr2&pds2REFR != 0, "REFR"},
+		{atr1&pds2OVLY != 0, "OVLY"},
+		{atr1&pds2SCTR != 0, "SCTR"},
+		{atr1&pds2TEST != 0, "TEST"},
+		{atr1&pds2OL != 0, "OL"},
+		{atr2&pds2NREP != 0, "NE"},
+	} {
+		if attr.set {
+			lm.Attributes = append(lm.Attributes, attr.name)
+		}
+	}
+
+	// The optional sections follow the basic section: scatter load, alias,
+	// SSI (on a halfword boundary) and APF, each present only if the
+	// corresponding flag is set.
+	off := 22
+	if atr1&pds2SCTR != 0 {
+		off += 8
+	}
+	if alias {
+		if off+11 <= len(udata) {
+			lm.AliasOf = strings.TrimRight(ctc.EtoS(udata[off+3:off+11]), " ")
+		}
+		off += 11
+	}
+	off += off % 2
+	if ftb1&pds2SSI != 0 {
+		off += 4
+	}
+	if ftb1&pds2APFL != 0 && off+2 <= len(udata) {
+		ac := int(udata[off+1])
+		lm.AuthorizationCode = &ac
+	}
+	return lm
+}
@@ -0,0 +1,66 @@
+package ctcapi_test
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc/ctctest"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctcapi"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/mvsmock"
+)
+
+// newMockAPI connects a ctcapi client with one adapter pair to server over
+// loopback, stopping both when the test ends.
+func newMockAPI(t *testing.T, server *mvsmock.Server,
+	handshake bool) ctcapi.CTCAPI {
+
+	t.Helper()
+	cmd, cmdPeer, err := ctctest.NewPair(0x500, ctc.HerculesVersionNew,
+		binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("couldn't connect command pair: %v", err)
+	}
+	data, dataPeer, err := ctctest.NewPair(0x501, ctc.HerculesVersionNew,
+		binary.LittleEndian)
+	if err != nil {
+		cmd.Close()
+		cmdPeer.Close()
+		t.Fatalf("couldn't connect data pair: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Serve(ctx, cmdPeer, dataPeer)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		cmd.Close()
+		data.Close()
+		cmdPeer.Close()
+		dataPeer.Close()
+	})
+
+	return ctcapi.New([]ctcapi.Pair{{Cmd: cmd, Data: data}}, 5*time.Second,
+		handshake)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
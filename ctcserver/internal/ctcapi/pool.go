@@ -0,0 +1,213 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// PairStatus describes the health of one pair of command and data adapters.
+type PairStatus struct {
+	// Index is the position of the pair in the list given to New.
+	Index int `json:"index"`
+
+	// LinkState is the state of the connection to Hercules; the lesser of
+	// the command and data adapters' states.
+	LinkState string `json:"link_state"`
+
+	// Busy is true if the pair is running a command.
+	Busy bool `json:"busy"`
+
+	// Requests is the number of commands the pair has run.
+	Requests uint64 `json:"requests"`
+
+	// Failures is the number of CCW exchanges on the pair that failed.
+	Failures uint64 `json:"failures"`
+
+	// LastError and LastErrorTime describe the most recent failure, if any.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	// Capabilities are those of the CTCSERV task serving the pair, if
+	// they're known yet.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+// pair is one pair of command and data adapters in the pool, with its health
+// statistics.
+type pair struct {
+	index           int
+	ctccmd, ctcdata ctc.CTC
+
+	// probe is true if CTCSERV is to be asked for its capabilities, rather
+	// than assumed to support only the original commands.
+	probe bool
+
+	mu            sync.Mutex
+	busy          bool
+	requests      uint64
+	failures      uint64
+	lastError     error
+	lastErrorTime time.Time
+
+	// caps are the capabilities of the CTCSERV task serving the pair, or nil
+	// if we haven't asked it yet. They're forgotten when the link is lost,
+	// since CTCSERV may have been replaced by the time it reconnects, except
+	// while handshaking, when losing the link is how we learn that CTCSERV
+	// predates the CAPS command.
+	caps        *Capabilities
+	handshaking bool
+}
+
+func (p *pair) state() ctc.State {
+	return min(p.ctccmd.State(), p.ctcdata.State())
+}
+
+func (p *pair) failed(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures++
+	p.lastError = err
+	p.lastErrorTime = time.Now()
+	if errors.Is(err, ctc.ErrNotConnected) && !p.handshaking {
+		p.caps = nil
+	}
+}
+
+func (p *pair) status() PairStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := PairStatus{
+		Index:        p.index,
+		LinkState:    p.state().String(),
+		Busy:         p.busy,
+		Requests:     p.requests,
+		Failures:     p.failures,
+		Capabilities: p.caps,
+	}
+	if p.lastError != nil {
+		t := p.lastErrorTime
+		status.LastError = p.lastError.Error()
+		status.LastErrorTime = &t
+	}
+	return status
+}
+
+func (c *ctcapi) Status() []PairStatus {
+	var statuses []PairStatus
+	for _, p := range c.pairs {
+		statuses = append(statuses, p.status())
+	}
+	return statuses
+}
+
+// acquire waits for an idle pair whose link is connected, and marks it busy.
+// Idle pairs that are disconnected are passed over, but if every pair is
+// disconnected we return ctc.ErrNotConnected rather than waiting for one to
+// reconnect. If ctx ends first, an error matching ErrBusy and ctx's error is
+// returned. The pair must be returned with release.
+//
+// The first time a pair is acquired after connecting, we handshake with
+// CTCSERV to learn its capabilities; if that fails, the pair is passed over
+// too.
+func (c *ctcapi) acquire(ctx context.Context) (*pair, error) {
+	// Don't start a command that would be canceled straight away, resetting
+	// the link.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Pairs we've taken from the idle pool but can't use are set aside until
+	// we're done, so we don't keep picking them.
+	var down []*pair
+	defer func() {
+		for _, p := range down {
+			c.idle <- p
+		}
+	}()
+
+	for {
+		// One of the pairs we set aside may have reconnected in the
+		// meantime.
+		for i, p := range down {
+			if p.state() == ctc.StateConnected {
+				down = slices.Delete(down, i, i+1)
+				if c.ready(ctx, p) {
+					return p.take(), nil
+				}
+				down = append(down, p)
+				if err := ctx.Err(); err != nil {
+					return nil, busy(err)
+				}
+				break
+			}
+		}
+		if len(down) == len(c.pairs) {
+			return nil, fmt.Errorf("%w: no CTC adapter pair is connected",
+				ctc.ErrNotConnected)
+		}
+
+		select {
+		case p := <-c.idle:
+			if p.state() == ctc.StateConnected && c.ready(ctx, p) {
+				return p.take(), nil
+			}
+			down = append(down, p)
+			if err := ctx.Err(); err != nil {
+				return nil, busy(err)
+			}
+		case <-ctx.Done():
+			return nil, busy(ctx.Err())
+		}
+	}
+}
+
+// busy wraps the error of a context that ended while waiting for a pair.
+func busy(err error) error {
+	return fmt.Errorf("%w: %w", ErrBusy, err)
+}
+
+// ready handshakes with the CTCSERV task serving the pair if we haven't
+// already, reporting whether the pair can be used.
+func (c *ctcapi) ready(ctx context.Context, p *pair) bool {
+	if err := p.handshake(ctx); err != nil {
+		log.Warn().Err(err).Msgf("couldn't handshake with CTCSERV on adapter "+
+			"pair %d", p.index)
+		return false
+	}
+	return true
+}
+
+// take marks the pair busy and counts the request.
+func (p *pair) take() *pair {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy = true
+	p.requests++
+	return p
+}
+
+// release returns a pair obtained from acquire to the idle pool.
+func (c *ctcapi) release(p *pair) {
+	p.mu.Lock()
+	p.busy = false
+	p.mu.Unlock()
+	c.idle <- p
+}
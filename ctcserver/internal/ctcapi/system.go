@@ -0,0 +1,231 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// SystemInfo describes the MVS system, from the CVT, the SMCA and the PCCA,
+// and the address spaces on the ASCB chain.
+type SystemInfo struct {
+	// SystemName is the SMF system ID, since MVS 3.8 has no other name for
+	// the system.
+	SystemName string `json:"system_name"`
+	SMFID      string `json:"smf_id"`
+
+	// IPLDate and IPLTime are when the system was IPLed, in local time, as
+	// YYYY-MM-DD and HH:MM:SS. They're empty if the SMCA doesn't have them.
+	IPLDate   string `json:"ipl_date"`
+	IPLTime   string `json:"ipl_time"`
+	IPLVolume string `json:"ipl_volume"`
+
+	// Release is the MVS release number from the CVT.
+	Release       string `json:"release"`
+	RealStorageKB int    `json:"real_storage_kb"`
+
+	// CPUModel is the model from the CPU ID, or from the CVT if the CPU ID
+	// isn't available, in which case CPUSerial and CPUVersion are empty.
+	CPUModel   string `json:"cpu_model"`
+	CPUSerial  string `json:"cpu_serial,omitempty"`
+	CPUVersion string `json:"cpu_version,omitempty"`
+
+	AddressSpaces []AddressSpace `json:"address_spaces"`
+}
+
+// AddressSpace is an active address space.
+type AddressSpace struct {
+	ASID int `json:"asid"`
+
+	// Name is the job, TSO user or started task name, or empty for a system
+	// address space that has none.
+	Name string `json:"name,omitempty"`
+
+	// Type is "job", "tso_user", "started_task" or "system".
+	Type string `json:"type"`
+}
+
+// addressSpaceTypes are the address space types for each type code in a
+// SYSINFO address space entry.
+var addressSpaceTypes = map[string]string{
+	"J": "job",
+	"T": "tso_user",
+	"S": "started_task",
+}
+
+// GetSystemInfo returns information about the MVS system and its active
+// address spaces, in the order they're on the ASCB chain.
+func (c *ctcapi) GetSystemInfo(ctx context.Context) (*SystemInfo, error) {
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Msg("getting system information")
+
+	if err := p.sendCommand(ctx, opSysInfo, nil); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in GetSystemInfo()")
+		return nil, err
+	}
+
+	log.Debug().Msg("GetSystemInfo(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"GetSystemInfo(): couldn't perform SenseRead(): %w", err)
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf(
+			"GetSystemInfo(): got %d bytes of data, expected 8", len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("GetSystemInfo(): unsuccessful result code: "+
+			"%02x/%02x", resultCode, additionalCode)
+		return nil, &ResultError{Op: "SYSINFO", Code: resultCode,
+			Additional: additionalCode}
+	}
+
+	log.Debug().Msg("GetSystemInfo(): reading system record")
+	data, err = p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read system record: %w", err)
+	}
+	if len(data) != 40 {
+		// We'll still read the address spaces to get back in sync with
+		// CTCSERV, and report the error afterward.
+		log.Error().Msgf("got length %d system record, but expected 40",
+			len(data))
+	}
+	recordLen := len(data)
+	info := &SystemInfo{}
+	if recordLen == 40 {
+		info = decodeSystemInfo(data)
+	}
+
+	info.AddressSpaces = []AddressSpace{}
+	var i int
+	for {
+		i++
+		log.Debug().Msgf("GetSystemInfo(): reading item %d", i)
+		data, err := p.ctcdata.SenseRead(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read item %d: %w", i, err)
+		}
+
+		if len(data) == 1 && data[0] == 0xFF {
+			// End of the ASCB chain. Done
+			break
+		}
+
+		if len(data) != 12 {
+			log.Error().Msgf("got length %d address space record, but "+
+				"expected 12", len(data))
+			// Rather than bailing out early, we will at least try to get
+			// system state back in sync by continuing to read records.
+			continue
+		}
+
+		info.AddressSpaces = append(info.AddressSpaces,
+			decodeAddressSpace(data))
+	}
+
+	if recordLen != 40 {
+		return nil, fmt.Errorf("got %d bytes of system record, expected 40",
+			recordLen)
+	}
+	return info, nil
+}
+
+// decodeSystemInfo decodes the 40-byte SYSINFO system record; see
+// MVS/SYSINFO for its layout.
+func decodeSystemInfo(data []byte) *SystemInfo {
+	info := &SystemInfo{
+		SMFID:     strings.TrimRight(ctc.EtoS(data[0:4]), " \x00"),
+		IPLVolume: strings.TrimRight(ctc.EtoS(data[4:10]), " \x00"),
+		Release:   strings.Trim(ctc.EtoS(data[10:14]), " \x00"),
+		CPUModel:  fmt.Sprintf("%04X", binary.BigEndian.Uint16(data[14:16])),
+	}
+	info.SystemName = info.SMFID
+
+	// The CPU ID is VVSSSSSSMMMM: version, serial and model, in hex digits.
+	if cpuid := ctc.EtoS(data[16:28]); len(cpuid) == 12 &&
+		strings.TrimSpace(cpuid) != "" {
+
+		info.CPUVersion = cpuid[0:2]
+		info.CPUSerial = cpuid[2:8]
+		info.CPUModel = cpuid[8:12]
+	}
+
+	if ipl, ok := decodeIPLDate(data[28:32]); ok {
+		info.IPLDate = ipl.Format("2006-01-02")
+		secs := binary.BigEndian.Uint32(data[32:36]) / 100
+		info.IPLTime = fmt.Sprintf("%02d:%02d:%02d", secs/3600,
+			secs/60%60, secs%60)
+	}
+
+	// CVTMZ00 is the address of the last byte of real storage.
+	info.RealStorageKB = int((uint64(binary.BigEndian.Uint32(data[36:40])) +
+		1) / 1024)
+
+	return info
+}
+
+// decodeIPLDate decodes a packed decimal 0CYYDDDF date, where C is 0 for the
+// 1900s and 1 for the 2000s. ok is false if it isn't a valid date.
+func decodeIPLDate(data []byte) (date time.Time, ok bool) {
+	// The digits are the second through seventh nibbles.
+	var digits [6]int
+	for i := range digits {
+		b := data[(i+1)/2]
+		if i%2 == 0 {
+			b &= 0x0F
+		} else {
+			b >>= 4
+		}
+		if b > 9 {
+			return time.Time{}, false
+		}
+		digits[i] = int(b)
+	}
+
+	year := 1900 + digits[0]*100 + digits[1]*10 + digits[2]
+	day := digits[3]*100 + digits[4]*10 + digits[5]
+	if digits[0] > 1 || day < 1 || day > 366 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.January, day, 0, 0, 0, 0, time.UTC), true
+}
+
+// decodeAddressSpace decodes a 12-byte SYSINFO address space entry.
+func decodeAddressSpace(data []byte) AddressSpace {
+	as := AddressSpace{
+		ASID: int(binary.BigEndian.Uint16(data[0:2])),
+		Type: addressSpaceTypes[ctc.EtoS(data[2:3])],
+	}
+	if as.Type == "" {
+		as.Type = "system"
+	}
+	if data[4] != 0x00 {
+		as.Name = strings.TrimSpace(ctc.EtoS(data[4:12]))
+	}
+	return as
+}
@@ -0,0 +1,174 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// VolumeInfo describes a DASD device and the volume mounted on it, from its
+// UCB and the format-4 and format-5 DSCBs in the volume's VTOC.
+type VolumeInfo struct {
+	// Volume is empty if no volume is mounted.
+	Volume     string `json:"volume"`
+	Device     string `json:"device"`
+	DeviceType string `json:"device_type"`
+	Online     bool   `json:"online"`
+	Reserved   bool   `json:"reserved"`
+	Resident   bool   `json:"resident"`
+
+	// MountStatus is "public", "private" or "storage", or empty if the UCB
+	// doesn't say.
+	MountStatus string `json:"mount_status,omitempty"`
+
+	// Cylinders and TracksPerCylinder are zero if the VTOC couldn't be
+	// read.
+	Cylinders         int `json:"cylinders,omitempty"`
+	TracksPerCylinder int `json:"tracks_per_cylinder,omitempty"`
+
+	// FreeSpace is nil if the VTOC couldn't be read, or if its free space
+	// information isn't valid, as after the volume was used by DOS.
+	FreeSpace *FreeSpace `json:"free_space,omitempty"`
+}
+
+// FreeSpace totals the free extents of a volume. The free space is Cylinders
+// full cylinders plus Tracks tracks, which may be more than a cylinder's
+// worth, since each extent's odd tracks are counted separately.
+type FreeSpace struct {
+	Cylinders        int `json:"cylinders"`
+	Tracks           int `json:"tracks"`
+	Extents          int `json:"extents"`
+	LargestCylinders int `json:"largest_extent_cylinders"`
+	LargestTracks    int `json:"largest_extent_tracks"`
+}
+
+// deviceTypes are the DASD models for each UCBTBYT4 unit type.
+var deviceTypes = map[byte]string{
+	0x08: "2314",
+	0x09: "3330",
+	0x0A: "3340",
+	0x0B: "3350",
+	0x0D: "3330-11",
+	0x0E: "3380",
+}
+
+// ListVolumes returns the DASD devices in the UCB table, in the order they
+// appear there.
+func (c *ctcapi) ListVolumes(ctx context.Context) ([]VolumeInfo, error) {
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Msg("listing volumes")
+
+	if err := p.sendCommand(ctx, opVolList, nil); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in ListVolumes()")
+		return nil, err
+	}
+
+	log.Debug().Msg("ListVolumes(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"ListVolumes(): couldn't perform SenseRead(): %w", err)
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf(
+			"ListVolumes(): got %d bytes of data, expected 8", len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("ListVolumes(): unsuccessful result code: %02x/%02x",
+			resultCode, additionalCode)
+		return nil, &ResultError{Op: "VOLLIST", Code: resultCode,
+			Additional: additionalCode}
+	}
+
+	volumes := []VolumeInfo{}
+	var i int
+	for {
+		i++
+		log.Debug().Msgf("ListVolumes(): reading item %d", i)
+		data, err := p.ctcdata.SenseRead(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read item %d: %w", i, err)
+		}
+
+		if len(data) == 1 && data[0] == 0xFF {
+			// End of the UCB table. Done
+			break
+		}
+
+		if len(data) != 36 {
+			log.Error().Msgf("got length %d volume record, but expected 36",
+				len(data))
+			// Rather than bailing out early, we will at least try to get
+			// system state back in sync by continuing to read records.
+			continue
+		}
+
+		volumes = append(volumes, decodeVolumeInfo(data))
+	}
+
+	return volumes, nil
+}
+
+// decodeVolumeInfo decodes a 36-byte VOLLIST entry; see MVS/VOLLIST for its
+// layout.
+func decodeVolumeInfo(data []byte) VolumeInfo {
+	var vol VolumeInfo
+	if data[0] != 0x00 {
+		vol.Volume = strings.TrimSpace(ctc.EtoS(data[0:6]))
+	}
+	vol.Device = strings.TrimSpace(ctc.EtoS(data[6:9]))
+	vol.DeviceType = deviceTypes[data[9]]
+	if vol.DeviceType == "" {
+		vol.DeviceType = fmt.Sprintf("unknown (%02X)", data[9])
+	}
+
+	vol.Online = data[10]&0x80 != 0
+	vol.Reserved = data[10]&0x20 != 0
+	vol.Resident = data[10]&0x04 != 0
+
+	switch {
+	case data[11]&0x10 != 0:
+		vol.MountStatus = "private"
+	case data[11]&0x08 != 0:
+		vol.MountStatus = "public"
+	case data[11]&0x04 != 0:
+		vol.MountStatus = "storage"
+	}
+
+	vol.Cylinders = int(binary.BigEndian.Uint16(data[14:16]))
+	vol.TracksPerCylinder = int(binary.BigEndian.Uint16(data[16:18]))
+
+	if data[12]&0x80 != 0 {
+		vol.FreeSpace = &FreeSpace{
+			Cylinders:        int(binary.BigEndian.Uint32(data[20:24])),
+			Tracks:           int(binary.BigEndian.Uint32(data[24:28])),
+			Extents:          int(binary.BigEndian.Uint32(data[28:32])),
+			LargestCylinders: int(binary.BigEndian.Uint16(data[18:20])),
+			LargestTracks:    int(binary.BigEndian.Uint16(data[32:34])),
+		}
+	}
+
+	return vol
+}
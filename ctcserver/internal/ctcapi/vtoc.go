@@ -0,0 +1,125 @@
+package ctcapi
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// volumeVersion is the first CTCSERV protocol version whose READ, WRITE and
+// MBRLIST commands accept the serial of the volume an uncataloged dataset is
+// on after their usual parameter.
+const volumeVersion = 8
+
+// GetVTOC returns the datasets on a volume, from the format-1 DSCBs in its
+// VTOC, whether or not they are cataloged. Type is empty in each entry.
+func (c *ctcapi) GetVTOC(ctx context.Context, volser string) ([]DSInfo,
+	error) {
+
+	param, err := volumeParam(volser)
+	if err != nil {
+		return nil, err
+	}
+	if param == nil {
+		return nil, invalidInput("volume serial is required")
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Hex("param", param).Msgf("reading VTOC of '%s'", volser)
+
+	if err := p.sendCommand(ctx, opVTOC, param); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in GetVTOC()")
+		return nil, err
+	}
+
+	log.Debug().Msg("GetVTOC(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetVTOC(): couldn't perform SenseRead(): %w",
+			err)
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf("GetVTOC(): got %d bytes of data, expected 8",
+			len(data))
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("GetVTOC(): unsuccessful result code: %02x/%02x",
+			resultCode, additionalCode)
+		return nil, &ResultError{Op: "VTOC", Code: resultCode,
+			Additional: additionalCode}
+	}
+
+	entries := []DSInfo{}
+	var i int
+	for {
+		i++
+		log.Debug().Msgf("GetVTOC(): reading item %d", i)
+		data, err := p.ctcdata.SenseRead(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read item %d: %w", i, err)
+		}
+
+		if len(data) == 1 && data[0] == 0xFF {
+			// End of the VTOC. Done
+			break
+		}
+
+		if len(data) != 147 {
+			log.Error().Msgf("got length %d VTOC record, but expected 147",
+				len(data))
+			// Rather than bailing out early, we will at least try to get
+			// system state back in sync by continuing to read records.
+			continue
+		}
+
+		dsinfo := decodeDSInfo(data)
+		dsinfo.Type = ""
+		entries = append(entries, dsinfo)
+	}
+
+	return entries, nil
+}
+
+// volumeParam returns the 6-byte volume serial to send after the parameter of
+// a READ, WRITE or MBRLIST command, or nil if volume is empty.
+func volumeParam(volume string) ([]byte, error) {
+	if volume == "" {
+		return nil, nil
+	}
+	volume = strings.ToUpper(volume)
+	if !volserRegex.MatchString(volume) {
+		return nil, invalidInput("volume serial is invalid")
+	}
+	return padEbcdic(volume, 6), nil
+}
+
+// checkVolume returns an error matching ErrUnsupported if a volume serial is
+// to be sent to a CTCSERV too old to accept one.
+func (p *pair) checkVolume(volparam []byte) error {
+	caps := p.capabilities()
+	if volparam != nil && caps != nil && caps.Version < volumeVersion {
+		return fmt.Errorf("%w: CTCSERV version %d doesn't support "+
+			"uncataloged datasets", ErrUnsupported, caps.Version)
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package ctcapi
+
+// Copyright 2022-2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// WriteOptions control how Write replaces the records of a dataset.
+type WriteOptions struct {
+	// Staged has CTCSERV write the records to a temporary dataset, and copy
+	// them over the target only once they have all arrived and Write tells
+	// it to commit them. If the transfer fails part way through, or ctx ends
+	// before the commit, the target is left untouched.
+	Staged bool
+
+	// Append adds the records after those already in a sequential dataset
+	// (OPEN EXTEND) instead of replacing them. PDS members can't be
+	// appended to.
+	Append bool
+
+	// Volume is the serial of the volume the dataset is on, to write a
+	// dataset that isn't cataloged.
+	Volume string
+}
+
+// WriteResult describes the dataset that Write wrote to.
+type WriteResult struct {
+	// RecFM is the record format of the dataset, as in DSInfo. It's empty if
+	// CTCSERV is too old to report it, in which case the dataset has
+	// fixed-length records.
+	RecFM     string `json:"recfm,omitempty"`
+	LRecLen   int    `json:"lrecl"`
+	BlockSize int    `json:"blksize,omitempty"`
+
+	// Records is the number of records written.
+	Records int `json:"records"`
+
+	// When appending, TotalRecords is the number of records in the dataset
+	// afterwards, and FirstTTR is the relative track and record, in hex, of
+	// the block that starts with the first record written.
+	TotalRecords int    `json:"total_records,omitempty"`
+	FirstTTR     string `json:"first_ttr,omitempty"`
+
+	// recfm is the DCB RECFM of the dataset.
+	recfm byte
+}
+
+// Flags in the optional 53rd byte of the WRITE parameter.
+const (
+	writeStaged  byte = 0x80
+	writeFormats byte = 0x40 // we can write any RECFM
+	writeAppend  byte = 0x20
+)
+
+// writeFlagsVersion is the first CTCSERV protocol version whose WRITE
+// command accepts the flags byte, and writeFormatsVersion and
+// writeAppendVersion the first that accept writeFormats and writeAppend.
+// Older versions reject a 53-byte parameter, and only write fixed-length
+// records.
+const (
+	writeFlagsVersion   = 5
+	writeFormatsVersion = 6
+	writeAppendVersion  = 7
+)
+
+// flags returns the WRITE flags byte for the options.
+func (o WriteOptions) flags() byte {
+	var flags byte
+	if o.Staged {
+		flags |= writeStaged
+	}
+	if o.Append {
+		flags |= writeAppend
+	}
+	return flags
+}
+
+func (c *ctcapi) Write(ctx context.Context, dsn string, inputds []string,
+	opts WriteOptions) (*WriteResult, error) {
+
+	// Confirm we have some records
+	if len(inputds) < 1 {
+		err := invalidInput("Data must contain at least 1 record")
+		log.Debug().Err(err).Msg("invalid data in Submit")
+		return nil, err
+	}
+
+	return c.write(ctx, dsn, opts,
+		func(format *WriteResult) ([][]byte, error) {
+			return textRecords(format, inputds)
+		})
+}
+
+func (c *ctcapi) WriteRaw(ctx context.Context, dsn string, data []byte,
+	opts WriteOptions) (*WriteResult, error) {
+
+	if len(data) < 1 {
+		err := invalidInput("Data must contain at least 1 record")
+		log.Debug().Err(err).Msg("invalid data in WriteRaw")
+		return nil, err
+	}
+
+	return c.write(ctx, dsn, opts,
+		func(format *WriteResult) ([][]byte, error) {
+			return rawRecords(format, data)
+		})
+}
+
+// textRecords converts lines of text to EBCDIC records in the format of the
+// dataset.
+func textRecords(format *WriteResult, lines []string) ([][]byte, error) {
+	records := make([][]byte, len(lines))
+	for i, line := range lines {
+		if max := format.maxLength(); len(line) > max {
+			return nil, invalidInput(
+				"line %d of input is %d characters; must be <= %d",
+				i+1, len(line), max)
+		}
+		if len(line) == 0 && format.recfm&recfmU == recfmU {
+			return nil, invalidInput("line %d of input is empty, but a "+
+				"RECFM=U dataset can't have empty records", i+1)
+		}
+		records[i] = format.record(ctc.StoE(line))
+	}
+	return records, nil
+}
+
+// rawRecords splits data into records of the dataset without translating
+// them.
+func rawRecords(format *WriteResult, data []byte) ([][]byte, error) {
+	var records [][]byte
+
+	switch format.recfm & recfmU {
+	case recfmV:
+		// Each record starts with its RDW, which counts itself.
+		for offset := 0; offset < len(data); {
+			if len(data)-offset < 4 {
+				return nil, invalidInput("record %d at offset %d is too "+
+					"short to hold an RDW", len(records)+1, offset)
+			}
+			recl := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+			if recl < 4 || recl > format.LRecLen ||
+				recl > len(data)-offset {
+
+				return nil, invalidInput("record %d at offset %d has an "+
+					"RDW length of %d; must be between 4 and %d, and no "+
+					"more than the %d bytes remaining", len(records)+1,
+					offset, recl, format.LRecLen, len(data)-offset)
+			}
+			records = append(records, data[offset:offset+recl])
+			offset += recl
+		}
+
+	case recfmU:
+		if format.BlockSize < 1 {
+			return nil, invalidInput("dataset has no BLKSIZE to split the " +
+				"data into records with")
+		}
+		for offset := 0; offset < len(data); offset += format.BlockSize {
+			end := min(offset+format.BlockSize, len(data))
+			records = append(records, data[offset:end])
+		}
+
+	default:
+		if format.LRecLen < 1 || len(data)%format.LRecLen != 0 {
+			return nil, invalidInput("data is %d bytes; must be a "+
+				"multiple of the LRECL, %d", len(data), format.LRecLen)
+		}
+		for offset := 0; offset < len(data); offset += format.LRecLen {
+			records = append(records, data[offset:offset+format.LRecLen])
+		}
+	}
+
+	return records, nil
+}
+
+// maxLength returns the length of the longest record that can be written to
+// the dataset, not counting the RDW of a variable-length record.
+func (w *WriteResult) maxLength() int {
+	switch w.recfm & recfmU {
+	case recfmV:
+		return w.LRecLen - 4
+	case recfmU:
+		return w.BlockSize
+	}
+	return w.LRecLen
+}
+
+// record converts data, which must be no longer than maxLength, to a record
+// in the format of the dataset: padded with spaces to LRECL for fixed-length
+// records, preceded by an RDW for variable-length records, and as it is for
+// undefined-length records.
+func (w *WriteResult) record(data []byte) []byte {
+	switch w.recfm & recfmU {
+	case recfmV:
+		// The RDW is the length of the record including itself, followed by
+		// two zero bytes (see page 24-25 of GC26-3874-0, OS/VS2 MVS Data
+		// Management Services Guide).
+		record := make([]byte, 4, len(data)+4)
+		binary.BigEndian.PutUint16(record[0:2], uint16(len(data)+4))
+		return append(record, data...)
+	case recfmU:
+		return data
+	}
+
+	padded := make([]byte, w.LRecLen)
+	for j := range padded {
+		padded[j] = 0x40
+	}
+	copy(padded, data)
+	return padded
+}
+
+// write sends the records returned by build over the contents of dataset
+// dsn. build is called once CTCSERV has told us the format of the dataset.
+func (c *ctcapi) write(ctx context.Context, dsn string, opts WriteOptions,
+	build func(format *WriteResult) ([][]byte, error)) (*WriteResult,
+	error) {
+
+	if !dsnameOptionalMemberRegex.MatchString(dsn) {
+		return nil, invalidInput("dataset name is invalid")
+	}
+
+	matches := dsnameOptionalMemberRegex.FindStringSubmatch(dsn)
+	pdsName := matches[1]
+	mbrName := matches[2]
+
+	if len(pdsName) > 44 {
+		return nil, invalidInput("dataset name too long; got %d characters "+
+			"but needs to be 44 or fewer", len(pdsName))
+	}
+	if len(mbrName) > 8 {
+		return nil, invalidInput("member name too long; got %d characters "+
+			"but needs to be 8 or fewer", len(mbrName))
+	}
+	if opts.Append && len(mbrName) > 0 {
+		return nil, invalidInput("only sequential datasets can be appended " +
+			"to, not PDS members")
+	}
+
+	// The dataset name must be 44 characters, padded with (EBCDIC) spaces.
+	pdsEbcdic := ctc.StoE(strings.ToUpper(pdsName))
+	pdsPadded := make([]byte, 44)
+	for i := range pdsPadded {
+		pdsPadded[i] = 0x40
+	}
+	copy(pdsPadded, pdsEbcdic)
+
+	// The member name must be 8 characters, padded with (EBCDIC) spaces.
+	mbrEbcdic := ctc.StoE(strings.ToUpper(mbrName))
+	mbrPadded := make([]byte, 8)
+	for i := range mbrPadded {
+		mbrPadded[i] = 0x40
+	}
+	copy(mbrPadded, mbrEbcdic)
+
+	volparam, err := volumeParam(opts.Volume)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(p)
+
+	log.Debug().Hex("pds", pdsEbcdic).Msgf("writing dataset '%s'",
+		pdsName)
+	if len(mbrName) > 0 {
+		log.Debug().Hex("member", mbrEbcdic).Msgf("writing member '%s'",
+			mbrName)
+	}
+
+	// Complete input is the 44-byte DS name followed by 8-byte member, and
+	// the flags if there are any (or if a volume serial follows them), so
+	// that older versions of CTCSERV can still do plain writes.
+	pdsPadded = append(pdsPadded, mbrPadded...)
+	flags := opts.flags()
+	caps := p.capabilities()
+	if opts.Staged && caps != nil && caps.Version < writeFlagsVersion {
+		return nil, fmt.Errorf("%w: CTCSERV version %d doesn't support "+
+			"staged writes", ErrUnsupported, caps.Version)
+	}
+	if opts.Append && caps != nil && caps.Version < writeAppendVersion {
+		return nil, fmt.Errorf("%w: CTCSERV version %d doesn't support "+
+			"appending", ErrUnsupported, caps.Version)
+	}
+	if err := p.checkVolume(volparam); err != nil {
+		return nil, err
+	}
+	if caps != nil && caps.Version >= writeFormatsVersion {
+		flags |= writeFormats
+	}
+	if flags != 0 || volparam != nil {
+		pdsPadded = append(pdsPadded, flags)
+		pdsPadded = append(pdsPadded, volparam...)
+	}
+
+	if err := p.sendCommand(ctx, opWrite, pdsPadded); err != nil {
+		log.Error().Err(err).Msg("sendCommand() error in Write()")
+		return nil, err
+	}
+
+	// With writeFormats, the initial response also has the RECFM, a
+	// reserved byte and the BLKSIZE of the dataset after the LRECL.
+	respLen := 8
+	if flags&writeFormats != 0 {
+		respLen = 12
+	}
+
+	log.Debug().Msg("Write(): reading initial response")
+	data, err := p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Write(): couldn't perform SenseRead(): %w", err)
+	}
+	if len(data) != 8 && len(data) != respLen {
+		return nil, fmt.Errorf("Write(): got %d bytes of data, expected %d",
+			len(data), respLen)
+	}
+
+	resultCode := binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		additionalCode := binary.BigEndian.Uint32(data[4:8])
+		log.Info().Msgf("Write(): unsuccessful result code: %02x/%02x",
+			resultCode, additionalCode)
+		return nil, &ResultError{Op: "WRITE", Code: resultCode,
+			Additional: additionalCode}
+	}
+	if len(data) != respLen {
+		return nil, fmt.Errorf("Write(): got %d bytes of data, expected %d",
+			len(data), respLen)
+	}
+
+	result := &WriteResult{
+		LRecLen: int(binary.BigEndian.Uint32(data[4:8])),
+		recfm:   recfmF,
+	}
+	if respLen == 12 {
+		result.recfm = data[8]
+		result.RecFM = recfmName(data[8])
+		result.BlockSize = int(binary.BigEndian.Uint16(data[10:12]))
+	}
+
+	records, buildErr := build(result)
+	if buildErr != nil {
+		log.Debug().Err(buildErr).Msg("invalid data in Write()")
+	}
+
+	var proceedCommand int32
+	var numLines int32
+
+	if buildErr != nil {
+		proceedCommand = 1
+	}
+	numLines = int32(len(records))
+
+	var initialRespBuf bytes.Buffer
+	binary.Write(&initialRespBuf, binary.BigEndian, proceedCommand)
+	binary.Write(&initialRespBuf, binary.BigEndian, numLines)
+
+	log.Debug().Msgf("Sending intent to proceed %02x with %d records",
+		proceedCommand, numLines)
+	if err := p.ctccmd.NakedWrite(ctx, initialRespBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	data, err = p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Write(): couldn't perform SenseRead() after "+
+			"intent to proceed: %w", err)
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf("Write(): got %d bytes of data after intent to "+
+			"proceed, expected 8", len(data))
+	}
+	resultCode = binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		log.Info().Msgf("Write(): unsuccessful result code after intent to "+
+			"proceed: %02x", resultCode)
+		return nil, &ResultError{Op: "WRITE", Code: resultCode,
+			Additional: binary.BigEndian.Uint32(data[4:8])}
+	}
+
+	// If we told the server we're not proceeding, it has closed the dataset
+	// without changes and we're done.
+	if buildErr != nil {
+		return nil, buildErr
+	}
+
+	log.Debug().Msgf("sending write command with %d records", len(records))
+
+	for i, record := range records {
+		log.Debug().Msg("Write(): sending record")
+		if err := p.ctccmd.ControlWrite(ctx, record); err != nil {
+			return nil, fmt.Errorf("error writing record: %w", err)
+		}
+
+		// We also expect a response on the data channel
+		log.Debug().Msg("Write(): reading response")
+		data, err := p.ctcdata.SenseRead(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading record response: %w", err)
+		}
+
+		if len(data) != 8 {
+			return nil, fmt.Errorf("got %d response length, expected 8",
+				len(data))
+		}
+		log.Debug().Msgf("Write(): got response %08x after record %d",
+			data, i)
+		resultCode := binary.BigEndian.Uint32(data[0:4])
+		if resultCode != 0 {
+			errmsg := &ResultError{Op: "WRITE", Code: resultCode,
+				Additional: binary.BigEndian.Uint32(data[4:8]), Record: i + 1}
+			log.Error().Err(errmsg).Msg("Write(): unsuccessful result code")
+			return nil, errmsg
+		}
+	}
+
+	// The staged records don't replace the target until we commit them. If
+	// ctx has ended, we abandon them instead, which we must still tell
+	// CTCSERV, so that exchange can't use ctx.
+	var abandoned error
+	if opts.Staged {
+		var commit uint32
+		if abandoned = ctx.Err(); abandoned != nil {
+			log.Info().Err(abandoned).Msg("Write(): abandoning staged records")
+			commit = 1
+			ctx = context.WithoutCancel(ctx)
+		}
+
+		var commitBuf bytes.Buffer
+		binary.Write(&commitBuf, binary.BigEndian, commit)
+		binary.Write(&commitBuf, binary.BigEndian, int32(len(records)))
+
+		log.Debug().Msgf("Write(): sending commit %02x", commit)
+		if err := p.ctccmd.NakedWrite(ctx, commitBuf.Bytes()); err != nil {
+			return nil, fmt.Errorf("error sending commit: %w", err)
+		}
+	}
+
+	log.Debug().Msg("Write(): getting final result")
+	data, err = p.ctcdata.SenseRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading final result: %w", err)
+	}
+
+	if len(data) != 8 && len(data) != 12 {
+		return nil, fmt.Errorf("unexpected final response length: %d",
+			len(data))
+	}
+	resultCode = binary.BigEndian.Uint32(data[0:4])
+	if resultCode != 0 {
+		errmsg := &ResultError{Op: "WRITE", Code: resultCode,
+			Additional: binary.BigEndian.Uint32(data[4:8])}
+		log.Error().Err(errmsg).Msg("Write(): unexpected final response code")
+		return nil, errmsg
+	}
+
+	// After an append, the final response also has the number of records
+	// in the dataset and the TTR0 of the first block written.
+	if opts.Append && abandoned == nil {
+		if len(data) != 12 {
+			return nil, fmt.Errorf("unexpected final response length "+
+				"after append: %d", len(data))
+		}
+		result.TotalRecords = int(binary.BigEndian.Uint32(data[4:8]))
+		result.FirstTTR = fmt.Sprintf("%06X", data[8:11])
+	}
+
+	if abandoned != nil {
+		return nil, abandoned
+	}
+	result.Records = len(records)
+	return result, nil
+}
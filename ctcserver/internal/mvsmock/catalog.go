@@ -0,0 +1,528 @@
+package mvsmock
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// Dataset is a non-VSAM dataset, cataloged unless Uncataloged is set.
+type Dataset struct {
+	Name      string
+	Volume    string
+	DSOrg     string // PS or PO
+	RecFM     string // F, FB, V, VB or U
+	LRecLen   int
+	BlockSize int
+	KeyLength int
+
+	// Expires and Referenced are left out of the DSCB if they're zero.
+	Created    time.Time
+	Expires    time.Time
+	Referenced time.Time
+
+	// SpaceUnits is CYL, TRK or BLK, and Primary and Secondary are the
+	// quantities of space allocated in those units. The dataset is given as
+	// many secondary extents as its records need, on a volume with the
+	// geometry of a 3350, but only the first is described in the DSCB.
+	SpaceUnits string
+	Primary    int
+	Secondary  int
+
+	RACF bool
+
+	// Password is "read" if a password is needed to read or write the
+	// dataset, "write" if only to write it, or empty. The emulation doesn't
+	// ask for passwords.
+	Password string
+
+	// InUse makes dynamic allocation of the dataset fail as though another
+	// job had it allocated, so READ, WRITE and MBRLIST can't use it.
+	InUse bool
+
+	// Records holds the EBCDIC records of a sequential dataset. Records of
+	// fixed-length datasets are LRecLen bytes long; records of variable
+	// length datasets do not include the record descriptor word.
+	Records [][]byte
+
+	// Members holds the members of a partitioned dataset, keyed by name.
+	Members map[string]*Member
+
+	// Uncataloged datasets can only be found through their volume. The
+	// emulation keeps one dataset of each name, so allocating a dataset
+	// replaces an uncataloged one with the same name.
+	Uncataloged bool
+}
+
+// Member is a member of a partitioned dataset.
+type Member struct {
+	Name string
+
+	// UserData is the user data portion of the directory entry, at most 62
+	// bytes, of which the first TTRs*4 hold TTRs (as for a load module).
+	UserData []byte
+	TTRs     int
+
+	// Alias marks the entry as an alias.
+	Alias bool
+
+	// Records holds the member's EBCDIC records, as for Dataset.Records.
+	Records [][]byte
+}
+
+// Job is a job that has been submitted to the emulated internal reader.
+type Job struct {
+	ID   string
+	Name string
+	JCL  []string
+}
+
+// AddDataset adds ds to the catalog, replacing any existing dataset with the
+// same name. Unset attributes are given defaults of a FB 80 dataset on
+// DefaultVolume.
+func (s *Server) AddDataset(ds *Dataset) {
+	ds.Name = strings.ToUpper(ds.Name)
+	if ds.Volume == "" {
+		ds.Volume = DefaultVolume
+	}
+	if ds.DSOrg == "" {
+		ds.DSOrg = "PS"
+	}
+	if ds.RecFM == "" {
+		ds.RecFM = "FB"
+	}
+	if ds.LRecLen == 0 {
+		ds.LRecLen = 80
+	}
+	if ds.BlockSize == 0 {
+		ds.BlockSize = ds.LRecLen * 39
+	}
+	if ds.Created.IsZero() {
+		ds.Created = time.Now()
+	}
+	if ds.SpaceUnits == "" {
+		ds.SpaceUnits, ds.Primary, ds.Secondary = "TRK", 15, 15
+	}
+	if ds.DSOrg == "PO" && ds.Members == nil {
+		ds.Members = make(map[string]*Member)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datasets[ds.Name] = ds
+}
+
+// Dataset returns the dataset with the given name, cataloged or not, or nil
+// if there is no such dataset.
+func (s *Server) Dataset(name string) *Dataset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.datasets[strings.ToUpper(name)]
+}
+
+// Jobs returns the jobs submitted so far, in submission order.
+func (s *Server) Jobs() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Job(nil), s.jobs...)
+}
+
+// LoadDir populates the catalog from a fixture directory. Each regular file
+// in dir becomes a sequential dataset, and each subdirectory becomes a
+// partitioned dataset whose members are the regular files within it. Dataset
+// and member names are the upper-cased file names. All datasets are FB 80,
+// and each line of a file becomes one record.
+func (s *Server) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		ds := &Dataset{Name: entry.Name(), LRecLen: 80}
+
+		if !entry.IsDir() {
+			ds.Records, err = loadRecords(path, ds.LRecLen)
+			if err != nil {
+				return err
+			}
+			s.AddDataset(ds)
+			continue
+		}
+
+		ds.DSOrg = "PO"
+		ds.Members = make(map[string]*Member)
+		members, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if m.IsDir() {
+				continue
+			}
+			records, err := loadRecords(filepath.Join(path, m.Name()),
+				ds.LRecLen)
+			if err != nil {
+				return err
+			}
+			info, err := m.Info()
+			if err != nil {
+				return err
+			}
+			name := strings.ToUpper(m.Name())
+			ds.Members[name] = &Member{Name: name, Records: records,
+				UserData: ISPFStats("MOCK", info.ModTime(), len(records))}
+		}
+		s.AddDataset(ds)
+	}
+
+	return nil
+}
+
+func loadRecords(path string, lrecl int) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > lrecl {
+			return nil, fmt.Errorf("%s: line %d is longer than %d",
+				path, len(records)+1, lrecl)
+		}
+		records = append(records, padName(line, lrecl))
+	}
+	return records, scanner.Err()
+}
+
+// ISPFStats builds the user data of a directory entry holding ISPF
+// statistics for version 1.0 of a member of the given number of lines,
+// created and last changed at t.
+func ISPFStats(user string, t time.Time, lines int) []byte {
+	udata := make([]byte, 30)
+	udata[0] = 1
+	udata[3] = packed(t.Second())
+	date := packedDate(t)
+	copy(udata[4:8], date)
+	copy(udata[8:12], date)
+	udata[12] = packed(t.Hour())
+	udata[13] = packed(t.Minute())
+	binary.BigEndian.PutUint16(udata[14:16], uint16(lines))
+	binary.BigEndian.PutUint16(udata[16:18], uint16(lines))
+	copy(udata[20:28], padName(user, 8))
+	return udata
+}
+
+// packedDate encodes t as a packed decimal date of the form 0CYYDDDF.
+func packedDate(t time.Time) []byte {
+	day := t.YearDay()
+	return []byte{byte(t.Year()/100 - 19), packed(t.Year() % 100),
+		packed(day / 10), byte(day%10)<<4 | 0x0F}
+}
+
+// packed encodes n, from 0 to 99, as two packed decimal digits.
+func packed(n int) byte {
+	return byte(n/10)<<4 | byte(n%10)
+}
+
+// TextRecords converts lines of text to EBCDIC records suitable for
+// Dataset.Records and Member.Records. When lrecl is non-zero, each record is
+// padded with spaces to that length as for a fixed-length dataset.
+func TextRecords(lrecl int, lines ...string) [][]byte {
+	records := make([][]byte, len(lines))
+	for i, line := range lines {
+		if lrecl > 0 {
+			records[i] = padName(line, lrecl)
+		} else {
+			records[i] = ctc.StoE(line)
+		}
+	}
+	return records
+}
+
+// lookup finds a cataloged dataset, returning the LOCATE return code if
+// it's not found.
+func (s *Server) lookup(name string) (*Dataset, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.datasets[name]
+	if !ok || ds.Uncataloged {
+		return nil, locateNotCat
+	}
+	return ds, 0
+}
+
+// obtain finds a dataset on a volume, cataloged or not, returning the OBTAIN
+// return code if it's not found. A volume is mounted if it's DefaultVolume or
+// any dataset is on it.
+func (s *Server) obtain(name, volume string) (*Dataset, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ds, ok := s.datasets[name]; ok && ds.Volume == volume {
+		return ds, 0
+	}
+	if !s.mounted(volume) {
+		return nil, obtainNoVol
+	}
+	return nil, obtainNoDSCB
+}
+
+// mounted reports whether volume is mounted. s.mu must be held.
+func (s *Server) mounted(volume string) bool {
+	if volume == DefaultVolume {
+		return true
+	}
+	for _, ds := range s.datasets {
+		if ds.Volume == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// volumes returns the serials of the mounted volumes in order:
+// DefaultVolume and every volume a dataset is on.
+func (s *Server) volumes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{DefaultVolume: true}
+	volumes := []string{DefaultVolume}
+	for _, ds := range s.datasets {
+		if !seen[ds.Volume] {
+			seen[ds.Volume] = true
+			volumes = append(volumes, ds.Volume)
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// volumeContents returns the datasets on volume in name order, or false if
+// the volume isn't mounted.
+func (s *Server) volumeContents(volume string) ([]*Dataset, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.mounted(volume) {
+		return nil, false
+	}
+	var results []*Dataset
+	for _, ds := range s.datasets {
+		if ds.Volume == volume {
+			results = append(results, ds)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, true
+}
+
+// search performs a generic catalog locate, returning all the datasets whose
+// names begin with prefix in name order.
+func (s *Server) search(prefix string) []*Dataset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []*Dataset
+	for name, ds := range s.datasets {
+		if !ds.Uncataloged && strings.HasPrefix(name, prefix) {
+			results = append(results, ds)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// fixed reports whether the dataset has fixed-length records.
+func (ds *Dataset) fixed() bool {
+	return strings.HasPrefix(ds.RecFM, "F")
+}
+
+// variable reports whether the dataset has variable-length records.
+func (ds *Dataset) variable() bool {
+	return strings.HasPrefix(ds.RecFM, "V")
+}
+
+// dscb builds the 96 bytes of a format-1 DSCB that follow the 44-byte key,
+// i.e. the data returned by OBTAIN beginning at DS1FMTID. See
+// SYS1.AMODGEN(IECSDSL1) for the field definitions.
+func (ds *Dataset) dscb() []byte {
+	d := make([]byte, 96)
+	d[0] = 0xF1                               // DS1FMTID
+	copy(d[1:7], padName(ds.Volume, 6))       // DS1DSSN
+	binary.BigEndian.PutUint16(d[7:9], 1)     // DS1VOLSQ
+	copy(d[9:12], dscbDate(ds.Created))       // DS1CREDT
+	copy(d[12:15], dscbDate(ds.Expires))      // DS1EXPDT
+	d[15] = byte(ds.extents())                // DS1NOEPV
+	copy(d[18:31], padName("IBM OS/VS2", 13)) // DS1SYSCD
+	copy(d[31:34], dscbDate(ds.Referenced))   // DS1REFD
+
+	switch ds.DSOrg {
+	case "PS":
+		d[38] = 0x40
+	case "PO":
+		d[38] = 0x02
+	}
+
+	switch {
+	case strings.HasPrefix(ds.RecFM, "U"):
+		d[40] = 0xC0
+	case strings.HasPrefix(ds.RecFM, "V"):
+		d[40] = 0x40
+	case strings.HasPrefix(ds.RecFM, "F"):
+		d[40] = 0x80
+	}
+	if strings.Contains(ds.RecFM[1:], "B") {
+		d[40] |= 0x10
+	}
+	if ds.variable() && strings.Contains(ds.RecFM[1:], "S") {
+		d[40] |= 0x08
+	}
+
+	binary.BigEndian.PutUint16(d[42:44], uint16(ds.BlockSize)) // DS1BLKL
+	binary.BigEndian.PutUint16(d[44:46], uint16(ds.LRecLen))   // DS1LRECL
+	d[46] = byte(ds.KeyLength)                                 // DS1KEYL
+
+	// DS1DSIND
+	if ds.RACF {
+		d[49] |= 0x40
+	}
+	switch ds.Password {
+	case "read":
+		d[49] |= 0x10
+	case "write":
+		d[49] |= 0x14
+	}
+
+	// DS1SCALO
+	binary.BigEndian.PutUint32(d[50:54], uint32(ds.Secondary)&0xFFFFFF)
+	switch ds.SpaceUnits {
+	case "CYL":
+		d[50] = 0xC0
+	case "TRK":
+		d[50] = 0x80
+	case "BLK":
+		d[50] = 0x40
+	}
+
+	// DS1LSTAR: the last block is on the last track used.
+	if used := ds.usedTracks(); used > 0 {
+		binary.BigEndian.PutUint16(d[54:56], uint16(used-1))
+		d[56] = 1
+	}
+
+	// DS1EXT1, starting at cylinder 1 of the volume.
+	if tracks := ds.tracks(ds.Primary); tracks > 0 {
+		last := tracksPerCyl + tracks - 1
+		d[61] = 0x01
+		binary.BigEndian.PutUint16(d[63:65], 1)
+		binary.BigEndian.PutUint16(d[67:69], uint16(last/tracksPerCyl))
+		binary.BigEndian.PutUint16(d[69:71], uint16(last%tracksPerCyl))
+	}
+	return d
+}
+
+// The geometry of the emulated volumes is that of a 3350.
+const (
+	volumeCyls   = 555
+	tracksPerCyl = 30
+	trackBytes   = 19069
+)
+
+// tracks converts a quantity of space in the dataset's SpaceUnits to tracks.
+func (ds *Dataset) tracks(quantity int) int {
+	switch ds.SpaceUnits {
+	case "CYL":
+		return quantity * tracksPerCyl
+	case "BLK":
+		return (quantity*ds.BlockSize + trackBytes - 1) / trackBytes
+	}
+	return quantity
+}
+
+// extents is the number of extents the dataset needs to hold its records:
+// the primary extent plus enough secondary extents, up to the limit of 16.
+func (ds *Dataset) extents() int {
+	over := ds.usedTracks() - ds.tracks(ds.Primary)
+	secondary := ds.tracks(ds.Secondary)
+	if over <= 0 || secondary <= 0 {
+		return 1
+	}
+	return min(1+(over+secondary-1)/secondary, 16)
+}
+
+// allocatedTracks is the number of tracks in the dataset's extents.
+func (ds *Dataset) allocatedTracks() int {
+	return ds.tracks(ds.Primary) + (ds.extents()-1)*ds.tracks(ds.Secondary)
+}
+
+// usedTracks estimates how many tracks the dataset's records occupy, if
+// they're written in full blocks.
+func (ds *Dataset) usedTracks() int {
+	n := 0
+	for _, record := range ds.Records {
+		n += len(record)
+	}
+	for _, mbr := range ds.Members {
+		for _, record := range mbr.Records {
+			n += len(record)
+		}
+	}
+	return (n + trackBytes - 1) / trackBytes
+}
+
+// blocks is the number of blocks that n records of the dataset fill.
+// Variable and undefined-length records are taken to be one per block.
+func (ds *Dataset) blocks(n int) int {
+	perBlock := 1
+	if ds.fixed() && ds.LRecLen > 0 && ds.BlockSize >= ds.LRecLen {
+		perBlock = ds.BlockSize / ds.LRecLen
+	}
+	return (n + perBlock - 1) / perBlock
+}
+
+// blockTTR returns the TTR of the block with the given (zero-based) index.
+func (ds *Dataset) blockTTR(block int) uint32 {
+	perTrack := 1
+	if ds.BlockSize > 0 && ds.BlockSize < trackBytes {
+		perTrack = trackBytes / ds.BlockSize
+	}
+	return uint32(block/perTrack)<<8 | uint32(block%perTrack+1)
+}
+
+// dscbDate encodes t as a 3-byte DSCB date: the year less 1900 followed by
+// the halfword day of the year.
+func dscbDate(t time.Time) []byte {
+	if t.IsZero() {
+		return []byte{0, 0, 0}
+	}
+	return []byte{byte(t.Year() - 1900), byte(t.YearDay() >> 8),
+		byte(t.YearDay())}
+}
@@ -0,0 +1,808 @@
+package mvsmock
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// dslist emulates the DSLIST command (0x01). The parameter is the prefix for
+// a generic catalog locate.
+func (c *session) dslist(param []byte) error {
+	prefix := ctc.EtoS(param)
+	results := c.s.search(prefix)
+
+	var rc uint32
+	if len(results) == 0 {
+		rc = locateNotCat
+	}
+
+	// The initial response is a fullword result code and halfword count.
+	resp := binary.BigEndian.AppendUint32(nil, rc)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(results)))
+	if err := c.data.ControlWrite(c.ctx, resp); err != nil {
+		return err
+	}
+
+	for _, ds := range results {
+		if err := c.data.ControlWrite(c.ctx, dslistEntry(ds)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dslistEntry builds the 147-byte record DSLIST sends for a dataset: the
+// catalog entry type, dataset name and volume, and the format-1 DSCB.
+func dslistEntry(ds *Dataset) []byte {
+	entry := make([]byte, 0, 147)
+	entry = append(entry, ctc.StoE("A")...) // non-VSAM catalog entry
+	entry = append(entry, padName(ds.Name, 44)...)
+	entry = append(entry, padName(ds.Volume, 6)...)
+	entry = append(entry, ds.dscb()...)
+	return entry
+}
+
+// vtoc emulates the VTOC command (0x0E). The parameter is the 6-byte serial
+// of a volume. The datasets on it are sent in name order as DSLIST entries
+// with a blank entry type, followed by a single X'FF' byte.
+func (c *session) vtoc(param []byte) error {
+	if len(param) != 6 {
+		return c.respond(rcBadLength, 0)
+	}
+
+	datasets, ok := c.s.volumeContents(parseName(param))
+	if !ok {
+		return c.respond(rcLocate, obtainFlag+obtainNoVol)
+	}
+
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	for _, ds := range datasets {
+		entry := dslistEntry(ds)
+		entry[0] = 0x40 // not from the catalog
+		if err := c.data.ControlWrite(c.ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return c.data.ControlWrite(c.ctx, []byte{0xFF})
+}
+
+// vollist emulates the VOLLIST command (0x0F), which has no parameter. Each
+// mounted volume is sent as an online 3350 at an address from 190 up, in
+// volume serial order, followed by a single X'FF' byte. DefaultVolume is a
+// storage volume and the rest are private. The free space on each is what's
+// left after cylinder 0 and the datasets' extents, as a single extent.
+func (c *session) vollist() error {
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	for i, volume := range c.s.volumes() {
+		datasets, _ := c.s.volumeContents(volume)
+		free := (volumeCyls - 1) * tracksPerCyl
+		for _, ds := range datasets {
+			free -= ds.allocatedTracks()
+		}
+		free = max(free, 0)
+		extents := 0
+		if free > 0 {
+			extents = 1
+		}
+
+		entry := make([]byte, 36)
+		copy(entry[0:6], padName(volume, 6))
+		copy(entry[6:9], padName(fmt.Sprintf("%03X", 0x190+i), 3))
+		entry[9] = 0x0B  // 3350
+		entry[10] = 0x80 // online
+		if volume == DefaultVolume {
+			entry[11] = 0x04 // storage
+		} else {
+			entry[11] = 0x10 // private
+		}
+		entry[12] = 0x80 // free space is valid
+		binary.BigEndian.PutUint16(entry[14:16], volumeCyls)
+		binary.BigEndian.PutUint16(entry[16:18], tracksPerCyl)
+		binary.BigEndian.PutUint16(entry[18:20], uint16(free/tracksPerCyl))
+		binary.BigEndian.PutUint32(entry[20:24], uint32(free/tracksPerCyl))
+		binary.BigEndian.PutUint32(entry[24:28], uint32(free%tracksPerCyl))
+		binary.BigEndian.PutUint32(entry[28:32], uint32(extents))
+		binary.BigEndian.PutUint16(entry[32:34], uint16(free%tracksPerCyl))
+		if err := c.data.ControlWrite(c.ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return c.data.ControlWrite(c.ctx, []byte{0xFF})
+}
+
+// systemAddressSpaces are the started tasks the emulated system always has,
+// ahead of CTCSERV. Submitted jobs end as soon as they're read in, so
+// CTCSERV is the only job ever active.
+var systemAddressSpaces = []string{"*MASTER*", "PCAUTH", "RASP", "TRACE",
+	"JES2"}
+
+// sysinfo emulates the SYSINFO command (0x11), describing a uniprocessor
+// 3033 with 16 MB of real storage, IPLed from DefaultVolume when the Server
+// was created.
+func (c *session) sysinfo() error {
+	c.s.mu.Lock()
+	ipl := c.s.ipl
+	c.s.mu.Unlock()
+
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	rec := make([]byte, 0, 40)
+	rec = append(rec, padName("MOCK", 4)...)
+	rec = append(rec, padName(DefaultVolume, 6)...)
+	rec = append(rec, padName("0370", 4)...)
+	rec = binary.BigEndian.AppendUint16(rec, 0x3033)
+	rec = append(rec, padName("FF0006113033", 12)...)
+	rec = append(rec, 0x01, byte(ipl.Year()%100/10<<4|ipl.Year()%10),
+		byte(ipl.YearDay()/100<<4|ipl.YearDay()/10%10),
+		byte(ipl.YearDay()%10<<4|0x0F))
+	secs := ipl.Hour()*3600 + ipl.Minute()*60 + ipl.Second()
+	rec = binary.BigEndian.AppendUint32(rec, uint32(secs*100))
+	rec = binary.BigEndian.AppendUint32(rec, 16*1024*1024-1)
+	if err := c.data.ControlWrite(c.ctx, rec); err != nil {
+		return err
+	}
+
+	asid := uint16(0)
+	send := func(kind, name string) error {
+		asid++
+		entry := binary.BigEndian.AppendUint16(nil, asid)
+		entry = append(entry, padName(kind, 1)...)
+		entry = append(entry, 0x00)
+		entry = append(entry, padName(name, 8)...)
+		return c.data.ControlWrite(c.ctx, entry)
+	}
+	for _, name := range systemAddressSpaces {
+		if err := send("S", name); err != nil {
+			return err
+		}
+	}
+	if err := send("J", c.s.JobName); err != nil {
+		return err
+	}
+
+	return c.data.ControlWrite(c.ctx, []byte{0xFF})
+}
+
+// caps emulates the CAPS command (0x06), responding with the protocol version
+// and the bitmap of supported opcodes.
+func (c *session) caps() error {
+	var ops [32]byte
+	for _, op := range supportedOps {
+		ops[op/8] |= 0x80 >> (op % 8)
+	}
+	resp := binary.BigEndian.AppendUint32(nil, rcOK)
+	resp = binary.BigEndian.AppendUint32(resp, Version)
+	resp = append(resp, ops[:]...)
+	return c.data.ControlWrite(c.ctx, resp)
+}
+
+// identify emulates the IDENTIFY command (0x0A), which has no parameter.
+func (c *session) identify() error {
+	resp := binary.BigEndian.AppendUint32(nil, rcOK)
+	resp = append(resp, padName(c.s.JobName, 8)...)
+	resp = append(resp, padName(c.s.JobID, 8)...)
+	return c.data.ControlWrite(c.ctx, resp)
+}
+
+// alloc emulates the ALLOC command (0x0B). The 77-byte parameter describes
+// the new dataset; see MVS/ALLOC for its layout.
+func (c *session) alloc(param []byte) error {
+	if len(param) != 77 {
+		return c.respond(rcBadLength, 0)
+	}
+
+	name := parseName(param[0:44])
+	if ds, _ := c.s.lookup(name); ds != nil {
+		return c.respond(rcExists, 0)
+	}
+
+	ds := &Dataset{
+		Name:      name,
+		Volume:    parseName(param[44:50]),
+		LRecLen:   int(binary.BigEndian.Uint16(param[64:66])),
+		BlockSize: int(binary.BigEndian.Uint16(param[66:68])),
+		Primary:   quantity(param[68:71]),
+		Secondary: quantity(param[71:74]),
+	}
+	switch param[59] {
+	case 0xC0:
+		ds.SpaceUnits = "CYL"
+	case 0x80:
+		ds.SpaceUnits = "TRK"
+	default:
+		ds.SpaceUnits = "BLK"
+	}
+	if param[60]&0x02 != 0 {
+		ds.DSOrg = "PO"
+	} else {
+		ds.DSOrg = "PS"
+	}
+	recfm := param[62]
+	switch recfm & 0xC0 {
+	case 0xC0:
+		ds.RecFM = "U"
+	case 0x40:
+		ds.RecFM = "V"
+	default:
+		ds.RecFM = "F"
+	}
+	if recfm&0x10 != 0 {
+		ds.RecFM += "B"
+	}
+	if recfm&0x08 != 0 {
+		ds.RecFM += "S"
+	}
+	c.s.AddDataset(ds)
+	log.Debug().Msgf("mvsmock: allocated %s", ds.Name)
+
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	// Like CTCSERV, respond with the new dataset as DSLIST would list it.
+	return c.data.ControlWrite(c.ctx, dslistEntry(ds))
+}
+
+// quantity decodes a 3-byte space quantity.
+func quantity(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// dsmaint emulates the DSMAINT command (0x0C). The 90-byte parameter is the
+// function (delete, uncatalog or rename), the flags, the dataset name and
+// the new dataset name.
+func (c *session) dsmaint(param []byte) error {
+	if len(param) != 90 || param[0] < 0x01 || param[0] > 0x03 {
+		return c.respond(rcBadLength, 0)
+	}
+	function, dryRun := param[0], param[1]&0x80 != 0
+	name, newName := parseName(param[2:46]), parseName(param[46:90])
+
+	ds, locrc := c.s.lookup(name)
+	if ds == nil {
+		return c.respond(rcLocate, locrc)
+	}
+	if function == 0x03 {
+		if existing, _ := c.s.lookup(newName); existing != nil {
+			return c.respond(rcExists, 0)
+		}
+	}
+	if dryRun {
+		return c.respond(rcOK, 0)
+	}
+
+	// Uncataloged datasets stay on their volume, where READ, WRITE, MBRLIST
+	// and VTOC can still find them.
+	c.s.mu.Lock()
+	delete(c.s.datasets, name)
+	switch function {
+	case 0x02:
+		ds.Uncataloged = true
+		c.s.datasets[name] = ds
+	case 0x03:
+		ds.Name = newName
+		c.s.datasets[newName] = ds
+	}
+	c.s.mu.Unlock()
+	log.Debug().Msgf("mvsmock: DSMAINT function %d on %s", function, name)
+
+	return c.respond(rcOK, 0)
+}
+
+// mbrmaint emulates the MBRMAINT command (0x0D). The 62-byte parameter is
+// the function (delete, rename or alias), the flags, the dataset name, the
+// member name and the new member name.
+func (c *session) mbrmaint(param []byte) error {
+	if len(param) != 62 || param[0] < 0x01 || param[0] > 0x03 {
+		return c.respond(rcBadLength, 0)
+	}
+	function, dryRun := param[0], param[1]&0x80 != 0
+	name := parseName(param[2:46])
+	mbr, newName := parseName(param[46:54]), parseName(param[54:62])
+
+	ds, locrc := c.s.lookup(name)
+	if ds == nil {
+		return c.respond(rcLocate, locrc)
+	}
+	if ds.DSOrg != "PO" {
+		return c.respond(rcFormat, 0)
+	}
+
+	rc, rc2 := c.s.updateDirectory(ds, function, mbr, newName, dryRun)
+	if rc == rcOK && !dryRun {
+		log.Debug().Msgf("mvsmock: MBRMAINT function %d on %s(%s)",
+			function, name, mbr)
+	}
+	return c.respond(rc, rc2)
+}
+
+// updateDirectory performs an MBRMAINT function on the members of ds,
+// returning the result and additional codes.
+func (s *Server) updateDirectory(ds *Dataset, function byte, mbr,
+	newName string, dryRun bool) (uint32, uint32) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := ds.Members[mbr]
+	if !ok {
+		return rcNoMember, bldlNotFound
+	}
+	if _, ok := ds.Members[newName]; ok && function != 0x01 {
+		return rcExists, 0
+	}
+	if dryRun {
+		return rcOK, 0
+	}
+
+	switch function {
+	case 0x01:
+		delete(ds.Members, mbr)
+	case 0x02:
+		delete(ds.Members, mbr)
+		m.Name = newName
+		ds.Members[newName] = m
+	case 0x03:
+		alias := *m
+		alias.Name, alias.Alias = newName, true
+		ds.Members[newName] = &alias
+	}
+	return rcOK, 0
+}
+
+// mbrlist emulates the MBRLIST command (0x02). The parameter is the 44-byte
+// name of a PDS, optionally followed by the serial of its volume.
+func (c *session) mbrlist(param []byte) error {
+	var volume string
+	switch len(param) {
+	case 44:
+	case 50:
+		volume = parseName(param[44:50])
+	default:
+		return c.respond(rcBadLength, 0)
+	}
+
+	ds, rc, rc2 := c.find(parseName(param[0:44]), volume)
+	if ds == nil {
+		return c.respond(rc, rc2)
+	}
+	if ds.DSOrg != "PO" {
+		return c.respond(rcFormat, 0)
+	}
+
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	c.s.mu.Lock()
+	names := make([]string, 0, len(ds.Members))
+	for name := range ds.Members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries [][]byte
+	for i, name := range names {
+		// Members are laid out four to a track after a track of directory
+		// blocks.
+		ttr := uint32(i/4+1)<<8 | uint32(i%4+1)
+		entries = append(entries, directoryEntry(ds.Members[name], ttr))
+	}
+	c.s.mu.Unlock()
+
+	// The directory always ends with an entry for the member name of all
+	// X'FF' bytes, which CTCSERV passes along as the end marker.
+	last := make([]byte, 74)
+	for i := 0; i < 8; i++ {
+		last[i] = 0xFF
+	}
+	entries = append(entries, last)
+
+	for _, entry := range entries {
+		if err := c.data.ControlWrite(c.ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// directoryEntry builds the 74-byte member record MBRLIST sends: the 8-byte
+// name, the directory entry's indicator byte, 62 bytes of user data, and the
+// TTR.
+func directoryEntry(m *Member, ttr uint32) []byte {
+	entry := make([]byte, 74)
+	copy(entry[0:8], padName(m.Name, 8))
+	udata := m.UserData
+	if len(udata) > 62 {
+		udata = udata[:62]
+	}
+	entry[8] = byte(len(udata)/2)&0x1F | byte(m.TTRs&3)<<5
+	if m.Alias {
+		entry[8] |= 0x80
+	}
+	copy(entry[9:71], udata)
+	entry[71], entry[72], entry[73] = byte(ttr>>16), byte(ttr>>8), byte(ttr)
+	return entry
+}
+
+// find looks a dataset up in the catalog, or if volume isn't empty, in the
+// VTOC of that volume, and allocates it. It returns the non-zero result and
+// additional codes to send if it's not found or can't be allocated.
+func (c *session) find(name, volume string) (*Dataset, uint32, uint32) {
+	var ds *Dataset
+	if volume == "" {
+		var locrc uint32
+		if ds, locrc = c.s.lookup(name); ds == nil {
+			return nil, rcLocate, locrc
+		}
+	} else {
+		var obtrc uint32
+		if ds, obtrc = c.s.obtain(name, volume); ds == nil {
+			return nil, rcLocate, obtainFlag + obtrc
+		}
+	}
+
+	if ds.InUse {
+		return nil, rcDynalloc, dynallocInUse
+	}
+	return ds, rcOK, 0
+}
+
+// openTarget performs the checks READ and WRITE share: that the 52-byte
+// parameter names a dataset (and optional member) of a supported
+// organization, in the catalog or on volume if it isn't empty. It returns
+// the non-zero result and additional codes to send if the checks fail.
+func (c *session) openTarget(param []byte, volume string) (ds *Dataset,
+	mbr string, rc, rc2 uint32) {
+
+	if len(param) != 52 {
+		return nil, "", rcBadLength, 0
+	}
+
+	ds, rc, rc2 = c.find(parseName(param[0:44]), volume)
+	if ds == nil {
+		return nil, "", rc, rc2
+	}
+
+	mbr = parseName(param[44:52])
+	if mbr == "" && ds.DSOrg != "PS" {
+		return nil, "", rcFormat, 0
+	}
+	if mbr != "" && ds.DSOrg != "PO" {
+		return nil, "", rcFormat, 0
+	}
+
+	return ds, mbr, rcOK, 0
+}
+
+// read emulates the READ command (0x03). The parameter is the 44-byte
+// dataset name followed by the 8-byte member name, and optionally the serial
+// of the dataset's volume.
+func (c *session) read(param []byte) error {
+	var volume string
+	if len(param) == 58 {
+		volume = parseName(param[52:58])
+		param = param[:52]
+	}
+	ds, mbr, rc, rc2 := c.openTarget(param, volume)
+	if rc != rcOK {
+		return c.respond(rc, rc2)
+	}
+	if !ds.fixed() && !ds.variable() {
+		return c.respond(rcFormat, 0)
+	}
+
+	c.s.mu.Lock()
+	records := ds.Records
+	if mbr != "" {
+		m, ok := ds.Members[mbr]
+		if !ok {
+			c.s.mu.Unlock()
+			return c.respond(rcNoMember, bldlNotFound)
+		}
+		records = m.Records
+	}
+	records = append([][]byte(nil), records...)
+	c.s.mu.Unlock()
+
+	var fixed uint32
+	if ds.fixed() {
+		fixed = 1
+	}
+	if err := c.respond(rcOK, fixed); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		// CTCSERV always sends LRECL bytes. For variable-length records,
+		// the RDW tells the receiver how much of that is real.
+		buf := make([]byte, ds.LRecLen)
+		if ds.variable() {
+			binary.BigEndian.PutUint16(buf[0:2], uint16(len(record)+4))
+			copy(buf[4:], record)
+		} else {
+			copy(buf, record)
+		}
+		if err := c.data.ControlWrite(c.ctx, buf); err != nil {
+			return err
+		}
+	}
+
+	// End of file marker
+	return c.data.ControlWrite(c.ctx, []byte{0xFF})
+}
+
+// submit emulates the SUBMIT command (0x04). The parameter is a fullword
+// count of the 80-byte JCL records that will follow on the command adapter.
+func (c *session) submit(param []byte) error {
+	if len(param) != 4 || int32(binary.BigEndian.Uint32(param)) <= 0 {
+		return c.respond(rcBadLength)
+	}
+	count := int(binary.BigEndian.Uint32(param))
+
+	if err := c.respond(rcOK); err != nil {
+		return err
+	}
+
+	jcl := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		record, err := c.cmd.SenseRead(c.ctx)
+		if err != nil {
+			return err
+		}
+		jcl = append(jcl, strings.TrimRight(ctc.EtoS(record), " "))
+		if err := c.respond(rcOK); err != nil {
+			return err
+		}
+	}
+
+	// JES2 rejects a job without a JOB statement, and the internal reader
+	// then returns CTCSERV's own job ID.
+	id := c.s.JobID
+	if jobName(jcl) != "" {
+		job := c.s.addJob(jcl)
+		log.Debug().Msgf("mvsmock: submitted %s as %s", job.Name, job.ID)
+		id = job.ID
+	} else {
+		log.Debug().Msg("mvsmock: rejected job with no JOB statement")
+	}
+
+	resp := binary.BigEndian.AppendUint32(nil, rcOK)
+	resp = append(resp, padName(id, 8)...)
+	return c.data.ControlWrite(c.ctx, resp)
+}
+
+func (s *Server) addJob(jcl []string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := &Job{
+		ID:   fmt.Sprintf("JOB%05d", s.nextJob),
+		Name: jobName(jcl),
+		JCL:  jcl,
+	}
+	s.nextJob++
+	s.jobs = append(s.jobs, job)
+
+	// Jobs don't really run, but they write the console messages a real job
+	// would, as though they ran as soon as they were read in.
+	now := time.Now().Format("15.04.05")
+	s.wto("$HASP100 %-8s ON INTRDR", job.Name)
+	s.wto("$HASP373 %-8s STARTED - INIT  1 - CLASS %s - SYS MOCK",
+		job.Name, jobClass(jcl))
+	s.wto("IEF403I %s - STARTED - TIME=%s", job.Name, now)
+	s.wto("IEF404I %s - ENDED - TIME=%s", job.Name, now)
+	s.wto("$HASP395 %-8s ENDED", job.Name)
+	return job
+}
+
+// jobName extracts the job name from the first JOB statement.
+func jobName(jcl []string) string {
+	for _, line := range jcl {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "JOB" &&
+			strings.HasPrefix(fields[0], "//") {
+			return strings.TrimPrefix(fields[0], "//")
+		}
+	}
+	return ""
+}
+
+// jobClass extracts the CLASS parameter from the first JOB statement,
+// defaulting to A.
+func jobClass(jcl []string) string {
+	for _, line := range jcl {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "JOB" {
+			continue
+		}
+		for _, param := range strings.Split(fields[2], ",") {
+			if class, ok := strings.CutPrefix(param, "CLASS="); ok &&
+				class != "" {
+				return class[:1]
+			}
+		}
+		break
+	}
+	return "A"
+}
+
+// Flags in the optional 53rd byte of the WRITE parameter.
+const (
+	writeStaged  byte = 0x80
+	writeFormats byte = 0x40
+	writeAppend  byte = 0x20
+)
+
+// write emulates the WRITE command (0x05). The parameter is the 44-byte
+// dataset name followed by the 8-byte member name, and optionally the flags
+// and then the serial of the dataset's volume.
+func (c *session) write(param []byte) error {
+	var flags byte
+	var volume string
+	if len(param) == 59 {
+		volume = parseName(param[53:59])
+		param = param[:53]
+	}
+	if len(param) == 53 {
+		flags = param[52]
+		param = param[:52]
+	}
+	staged := flags&writeStaged != 0
+	appending := flags&writeAppend != 0
+
+	ds, mbr, rc, rc2 := c.openTarget(param, volume)
+	if rc != rcOK {
+		return c.respond(rc, rc2)
+	}
+	if appending && mbr != "" {
+		return c.respond(rcFormat, 0)
+	}
+	// Without writeFormats, CTCSERV only tests the F bit of RECFM, which is
+	// also set for U. With it, any record format will do.
+	recfm := ds.dscb()[40]
+	if recfm&0xC0 == 0 ||
+		flags&writeFormats == 0 && !ds.fixed() && !strings.HasPrefix(ds.RecFM, "U") {
+		return c.respond(rcFormat, 0)
+	}
+
+	// With writeFormats, the LRECL is followed by the RECFM, a reserved byte
+	// and the BLKSIZE.
+	resp := []uint32{rcOK, uint32(ds.LRecLen)}
+	if flags&writeFormats != 0 {
+		resp = append(resp, uint32(recfm)<<24|uint32(ds.BlockSize))
+	}
+	if err := c.respond(resp...); err != nil {
+		return err
+	}
+
+	// The caller tells us whether to proceed, and how many records to
+	// expect, with a WRITE not preceded by a CONTROL.
+	intent, err := c.cmd.ReadWrite(c.ctx)
+	if err != nil {
+		return err
+	}
+	if len(intent) != 8 {
+		return c.respond(rcCTCRead, 0)
+	}
+	proceed := binary.BigEndian.Uint32(intent[0:4])
+	count := binary.BigEndian.Uint32(intent[4:8])
+	if proceed != 0 {
+		// The caller aborted; CTCSERV opens the dataset for input (so it's
+		// left untouched) and reports a normal completion.
+		return c.respond(rcOK, count)
+	}
+
+	// Opening a sequential dataset for output discards its contents right
+	// away, unless we're appending. A new member version doesn't replace
+	// the old one until it's stowed when the dataset is closed. Staged
+	// records don't go near the target until they're committed.
+	c.s.mu.Lock()
+	existing := len(ds.Records)
+	if mbr == "" && !staged && !appending {
+		ds.Records = nil
+	}
+	c.s.mu.Unlock()
+
+	if err := c.respond(rcOK, count); err != nil {
+		return err
+	}
+
+	var records [][]byte
+	for i := uint32(0); i < count; i++ {
+		record, err := c.cmd.SenseRead(c.ctx)
+		if err != nil {
+			return err
+		}
+		// We keep variable-length records without their RDW.
+		if ds.variable() {
+			if len(record) < 4 ||
+				int(binary.BigEndian.Uint16(record[0:2])) != len(record) {
+				return c.respond(rcPut, uint32(i+1))
+			}
+			record = record[4:]
+		}
+		records = append(records, record)
+		if mbr == "" && !staged {
+			c.s.mu.Lock()
+			ds.Records = append(ds.Records, record)
+			c.s.mu.Unlock()
+		}
+		if err := c.respond(rcOK, count); err != nil {
+			return err
+		}
+	}
+
+	if staged {
+		// The caller commits the staged records with a zero word, or
+		// abandons them with anything else.
+		commit, err := c.cmd.ReadWrite(c.ctx)
+		if err != nil {
+			return err
+		}
+		if len(commit) != 8 {
+			return c.respond(rcCTCRead, 0)
+		}
+		if binary.BigEndian.Uint32(commit[0:4]) != 0 {
+			log.Debug().Msgf("mvsmock: abandoned %d staged records",
+				len(records))
+			return c.respond(rcOK, count)
+		}
+		if mbr == "" {
+			c.s.mu.Lock()
+			if appending {
+				ds.Records = append(ds.Records, records...)
+			} else {
+				ds.Records = records
+			}
+			c.s.mu.Unlock()
+		}
+	}
+
+	if mbr != "" {
+		c.s.mu.Lock()
+		m, ok := ds.Members[mbr]
+		if !ok {
+			m = &Member{Name: mbr}
+			ds.Members[mbr] = m
+		}
+		m.Records = records
+		c.s.mu.Unlock()
+	}
+
+	// After an append, CTCSERV also sends the number of records in the
+	// dataset, and the TTR0 of the first block written. Appended records
+	// start a new block.
+	if appending {
+		return c.respond(rcOK, uint32(existing)+count,
+			ds.blockTTR(ds.blocks(existing))<<8)
+	}
+	return c.respond(rcOK, count)
+}
@@ -0,0 +1,129 @@
+package mvsmock
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// consoleMessage is a message written to the emulated console.
+type consoleMessage struct {
+	seq  uint32
+	time time.Time
+	text string
+}
+
+// maxConsoleMessages is how many messages the emulated console keeps.
+const maxConsoleMessages = 500
+
+// wto writes a message to the emulated console. s.mu must be held.
+func (s *Server) wto(format string, a ...any) {
+	s.nextMsg++
+	s.console = append(s.console, consoleMessage{
+		seq:  s.nextMsg,
+		time: time.Now(),
+		text: fmt.Sprintf(format, a...),
+	})
+	if len(s.console) > maxConsoleMessages {
+		s.console = s.console[len(s.console)-maxConsoleMessages:]
+	}
+}
+
+// messagesAfter returns the console messages with sequence numbers after seq,
+// and the sequence number of the newest message.
+func (s *Server) messagesAfter(seq uint32) ([]consoleMessage, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []consoleMessage
+	for _, msg := range s.console {
+		if msg.seq > seq {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, s.nextMsg
+}
+
+// lastMessage returns the sequence number of the newest console message.
+func (s *Server) lastMessage() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextMsg
+}
+
+// operatorCommand emulates an operator command, writing its response to the
+// console. Only a few DISPLAY commands are understood.
+func (s *Server) operatorCommand(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	verb, operands, _ := strings.Cut(command, " ")
+	operands = strings.TrimSpace(operands)
+	now := time.Now()
+
+	switch {
+	case (verb == "D" || verb == "DISPLAY") && operands == "T":
+		s.wto("IEE136I LOCAL: TIME=%s DATE=%s", now.Format("15.04.05"),
+			now.Format("06")+fmt.Sprintf(".%03d", now.YearDay()))
+	case (verb == "D" || verb == "DISPLAY") &&
+		(operands == "A" || strings.HasPrefix(operands, "A,")):
+
+		// Submitted jobs end as soon as they're read in, so CTCSERV is
+		// the only job ever active.
+		s.wto("IEE104I %s %s ACTIVITY", now.Format("15.04.05"),
+			now.Format("06")+fmt.Sprintf(".%03d", now.YearDay()))
+		s.wto(" JOBS    M/S    TS USERS    SYSAS    INITS")
+		s.wto(" 00001    00001    00000      00003    00003")
+		s.wto(" %-8s %-8s %-8s", s.JobName, s.JobName, "STEP1")
+	case verb == "$DA":
+		s.wto("$HASP608 %-8s EXECUTING A", s.JobName)
+	default:
+		s.wto("IEE305I %s COMMAND INVALID", verb)
+	}
+}
+
+// console emulates the CONSOLE command (0x10). The parameter is the number of
+// seconds to collect messages for, the 4-byte sequence number of the last
+// message the client has seen (X'FFFFFFFF' for none), and the operator
+// command to issue, if any. The emulated console's responses are immediate,
+// so the messages are sent without waiting out the time.
+func (c *session) console(param []byte) error {
+	if len(param) < 5 || len(param) > 131 {
+		return c.respond(rcBadLength, 0)
+	}
+
+	seq := binary.BigEndian.Uint32(param[1:5])
+	if seq == 0xFFFFFFFF {
+		seq = c.s.lastMessage()
+	}
+	if command := parseName(param[5:]); command != "" {
+		c.s.operatorCommand(command)
+	}
+
+	msgs, last := c.s.messagesAfter(seq)
+	if err := c.respond(rcOK, 0); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		entry := binary.BigEndian.AppendUint32(nil, msg.seq)
+		entry = append(entry, padName(msg.time.Format("15.04.05"), 8)...)
+		entry = append(entry, padName(msg.text, 126)...)
+		if err := c.data.ControlWrite(c.ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	end := binary.BigEndian.AppendUint32([]byte{0xFF}, last)
+	return c.data.ControlWrite(c.ctx, end)
+}
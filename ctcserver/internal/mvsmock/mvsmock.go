@@ -0,0 +1,250 @@
+// Package mvsmock is a Go emulation of the CTCSERV program that runs on the
+// MVS side of the CTC connection. It speaks the same command protocol as the
+// assembler implementation, but serves datasets, PDS members and a job queue
+// from an in-memory catalog, allowing the ctcapi package and the HTTP API to
+// be exercised without an IPL'd MVS 3.8 system.
+//
+// The emulation mirrors the observable behavior of the assembler code
+// (including its result codes and the order of CCWs on each adapter) rather
+// than what MVS itself might do, since it's the behavior of CTCSERV that the
+// Go side depends on.
+package mvsmock
+
+// Copyright 2023 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of CTC Mainframe API. CTC Mainframe API is free software:
+// you can redistribute it and/or modify it under the terms of the GNU General
+// Public License as published by the Free Software Foundation, either version
+// 3 of the license, or (at your option) any later version.
+//
+// https://github.com/racingmars/ctc-mainframe-api/
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+)
+
+// These must match the opcodes understood by CTCSERV and sent by ctcapi.
+const (
+	opDSList   byte = 0x01
+	opMbrList  byte = 0x02
+	opRead     byte = 0x03
+	opSubmit   byte = 0x04
+	opWrite    byte = 0x05
+	opCaps     byte = 0x06
+	opIdentify byte = 0x0A
+	opAlloc    byte = 0x0B
+	opDSMaint  byte = 0x0C
+	opMbrMaint byte = 0x0D
+	opVTOC     byte = 0x0E
+	opVolList  byte = 0x0F
+	opConsole  byte = 0x10
+	opSysInfo  byte = 0x11
+	opQuit     byte = 0xFF
+)
+
+// Version is the CTCSERV protocol version reported by the CAPS command.
+const Version = 11
+
+// supportedOps are the opcodes reported by the CAPS command.
+var supportedOps = []byte{opDSList, opMbrList, opRead, opSubmit, opWrite,
+	opCaps, opIdentify, opAlloc, opDSMaint, opMbrMaint, opVTOC, opVolList,
+	opConsole, opSysInfo, opQuit}
+
+// Result codes returned by the CTCSERV command implementations.
+const (
+	rcOK         uint32 = 0x00
+	rcBadLength  uint32 = 0xF0
+	rcLocate     uint32 = 0xF1
+	rcFormat     uint32 = 0xF2
+	rcDynalloc   uint32 = 0xF3
+	rcNoMember   uint32 = 0xF4
+	rcCTCRead    uint32 = 0xF5
+	rcPut        uint32 = 0xF6
+	rcCTCSense   uint32 = 0xF7
+	rcExists     uint32 = 0xFB
+	rcUnknownCmd uint32 = 0xFE
+	locateNotCat uint32 = 8 // LOCATE return code: name not found
+	obtainFlag   uint32 = 0x100
+	obtainNoVol  uint32 = 4 // OBTAIN return code: volume not mounted
+	obtainNoDSCB uint32 = 8 // OBTAIN return code: DSCB not found
+	bldlNotFound uint32 = 4 // BLDL return code: member not found
+
+	// DYNALLOC error and information codes: dataset in use by another job
+	dynallocInUse uint32 = 0x02100000
+)
+
+// DefaultVolume is the volume serial datasets are placed on when none is
+// specified.
+const DefaultVolume = "MOCK01"
+
+// Server holds the emulated catalog and job queue. A single Server may serve
+// any number of CTC adapter pairs concurrently.
+type Server struct {
+	mu       sync.Mutex
+	datasets map[string]*Dataset
+	jobs     []*Job
+	nextJob  int
+
+	// console holds the newest messages written to the emulated console,
+	// and nextMsg is the sequence number of the last one.
+	console []consoleMessage
+	nextMsg uint32
+
+	// ipl is when the emulated system was IPLed: when the Server was
+	// created.
+	ipl time.Time
+
+	// JobName and JobID identify the job CTCSERV itself is running as.
+	// Like the real internal reader, the emulation returns JobID in place
+	// of a new job ID when it rejects a job.
+	JobName string
+	JobID   string
+
+	// Legacy makes the server behave like a CTCSERV from before the CAPS
+	// command was added, which doesn't respond to it or to any other
+	// unrecognized command.
+	Legacy bool
+}
+
+// New creates a Server with an empty catalog.
+func New() *Server {
+	return &Server{
+		datasets: make(map[string]*Dataset),
+		nextJob:  2,
+		JobName:  "CTCSERV",
+		JobID:    "JOB00001",
+		ipl:      time.Now(),
+	}
+}
+
+// Adapter is the MVS side of an emulated CTC adapter, such as a
+// ctctest.Peer.
+type Adapter interface {
+	ctc.CTC
+
+	// ReadWrite receives data sent with a WRITE that was not preceded by a
+	// CONTROL, as CTCSERV does with a bare READ CCW.
+	ReadWrite(ctx context.Context) ([]byte, error)
+}
+
+// session is one command being processed over a pair of CTC adapters.
+type session struct {
+	ctx       context.Context
+	s         *Server
+	cmd, data Adapter
+}
+
+// Serve processes commands arriving on cmd, sending responses on data, until
+// it receives a quit command (in which case it returns nil), an error occurs
+// on either adapter, or ctx ends.
+func (s *Server) Serve(ctx context.Context, cmd, data Adapter) error {
+	c := &session{ctx: ctx, s: s, cmd: cmd, data: data}
+
+	for {
+		buf, err := cmd.SenseRead(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The command area is a 1-byte opcode, a 2-byte parameter length,
+		// and up to 255 bytes of parameter.
+		if len(buf) < 3 {
+			log.Warn().Msgf("mvsmock: short command of %d bytes", len(buf))
+			continue
+		}
+		op := buf[0]
+		param := buf[3:]
+		if plen := int(binary.BigEndian.Uint16(buf[1:3])); plen < len(param) {
+			param = param[:plen]
+		}
+
+		log.Debug().Hex("param", param).Msgf("mvsmock: got opcode %02x", op)
+
+		switch op {
+		case opDSList:
+			err = c.dslist(param)
+		case opMbrList:
+			err = c.mbrlist(param)
+		case opRead:
+			err = c.read(param)
+		case opSubmit:
+			err = c.submit(param)
+		case opWrite:
+			err = c.write(param)
+		case opCaps:
+			if s.Legacy {
+				log.Warn().Msg("mvsmock: ignoring CAPS command in legacy mode")
+				break
+			}
+			err = c.caps()
+		case opIdentify:
+			if s.Legacy {
+				log.Warn().Msg("mvsmock: ignoring IDENTIFY command in legacy " +
+					"mode")
+				break
+			}
+			err = c.identify()
+		case opAlloc:
+			err = c.alloc(param)
+		case opDSMaint:
+			err = c.dsmaint(param)
+		case opMbrMaint:
+			err = c.mbrmaint(param)
+		case opVTOC:
+			err = c.vtoc(param)
+		case opVolList:
+			err = c.vollist()
+		case opConsole:
+			err = c.console(param)
+		case opSysInfo:
+			err = c.sysinfo()
+		case opQuit:
+			return nil
+		default:
+			log.Warn().Msgf("mvsmock: unknown command %02x received", op)
+			if !s.Legacy {
+				err = c.respond(rcUnknownCmd)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// respond sends a response on the data adapter made up of the provided
+// fullwords.
+func (c *session) respond(words ...uint32) error {
+	var buf []byte
+	for _, w := range words {
+		buf = binary.BigEndian.AppendUint32(buf, w)
+	}
+	return c.data.ControlWrite(c.ctx, buf)
+}
+
+// parseName splits the fixed-length, space-padded EBCDIC name fields of a
+// command parameter into Go strings.
+func parseName(e []byte) string {
+	n := len(e)
+	for n > 0 && (e[n-1] == 0x40 || e[n-1] == 0x00) {
+		n--
+	}
+	return ctc.EtoS(e[:n])
+}
+
+// padName returns s as an EBCDIC field of length n, padded with spaces.
+func padName(s string, n int) []byte {
+	padded := make([]byte, n)
+	for i := range padded {
+		padded[i] = 0x40
+	}
+	copy(padded, ctc.StoE(s))
+	return padded
+}
@@ -10,11 +10,16 @@ package main
 // https://github.com/racingmars/ctc-mainframe-api/
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -22,7 +27,9 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctc/ctctest"
 	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/ctcapi"
+	"github.com/racingmars/ctc-mainframe-api/ctcserver/internal/mvsmock"
 )
 
 func main() {
@@ -32,6 +39,9 @@ func main() {
 	flagConfig := flag.String("config", "config.json", "Config file path")
 	flagCodepage := flag.String("codepage", "bracket",
 		"Code page - 'bracket' or 'cp37'")
+	flagMock := flag.String("mock", "",
+		"Serve datasets from this fixture directory using a built-in "+
+			"emulation of CTCSERV instead of connecting to Hercules")
 
 	fmt.Println()
 	fmt.Println("CTC Mainframe API")
@@ -77,7 +87,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if i := realMain(*flagConfig); i > 0 {
+	if i := realMain(*flagConfig, *flagMock); i > 0 {
 		os.Exit(i)
 	}
 }
@@ -85,28 +95,51 @@ func main() {
 // we wrap most of "main" in a realMain() function that returns an exit code.
 // This allows the real main() function to use os.Exit() if necessary, but
 // returning from realMain() allows any defers to still run.
-func realMain(configPath string) int {
+func realMain(configPath, mockDir string) int {
 
 	config, err := readConfig(configPath)
+	if mockDir != "" && errors.Is(err, fs.ErrNotExist) {
+		// The emulation doesn't need any settings to connect.
+		log.Info().Msgf("no config file at %s; using the defaults for -mock",
+			configPath)
+		config, err = mockConfig(), nil
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("couldn't read server configuration")
 		return 1
 	}
 
 	// Get our CTC command and data emulated devices
-	ctccmd, ctcdata, err := connect(config)
+	var pairs []ctcapi.Pair
+	if mockDir != "" {
+		pairs, err = connectMock(mockDir, len(config.Adapters))
+	} else {
+		pairs, err = connect(config)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("unable to connect to Hercules")
 		return 1
 	}
 
-	defer ctccmd.Close()
-	defer ctcdata.Close()
+	for _, pair := range pairs {
+		defer pair.Cmd.Close()
+		defer pair.Data.Close()
+	}
 
 	// ...and use them for our CTC API
-	capi := ctcapi.New(ctccmd, ctcdata)
+	// The emulation always understands the CAPS handshake.
+	handshake := *config.CTCSERVHandshake || mockDir != ""
+	if !handshake {
+		log.Warn().Msg("ctcserv_handshake is false, so only the original " +
+			"functions are available: job rejection isn't detected and " +
+			"newer commands such as allocate, console and sysinfo are off")
+	}
+	capi := ctcapi.New(pairs, time.Duration(config.CTCTimeout)*time.Second,
+		handshake)
 	app := api{
-		ctcapi: capi,
+		ctcapi:          capi,
+		consoleCommands: config.ConsoleCommands,
+		consoleWatcher:  ctcapi.NewConsoleWatcher(capi, 0),
 	}
 
 	// Set up the echo HTTP service
@@ -115,13 +148,27 @@ func realMain(configPath string) int {
 	e.Use(middleware.CORS())
 	e.Use(middleware.Logger())
 
-	// Add our API endpoints
-	e.GET("/api/dslist/:prefix", app.dslist)
-	e.GET("/api/mbrlist/:pdsName", app.mbrlist)
-	e.GET("/api/read/:dsn", app.read)
-	e.POST("/api/submit", app.submit)
-	e.POST("/api/write/:dsn", app.write)
-	e.GET("/api/quit", app.quit)
+	// The adapter status is available even while the link is down.
+	e.GET("/api/adapters", app.adapters)
+
+	// Add our API endpoints. They all need the CTC link to be up.
+	g := e.Group("/api", app.requireLink)
+	g.GET("/dslist/:prefix", app.dslist)
+	g.GET("/mbrlist/:pdsName", app.mbrlist)
+	g.GET("/read/:dsn", app.read)
+	g.POST("/submit", app.submit)
+	g.POST("/write/:dsn", app.write)
+	g.POST("/datasets/:dsn", app.allocate)
+	g.DELETE("/datasets/:dsn", app.deleteDataset)
+	g.POST("/datasets/:dsn/rename", app.renameDataset)
+	g.POST("/datasets/:dsn/alias", app.aliasMember)
+	g.GET("/volumes", app.volumes)
+	g.GET("/volumes/:volser/vtoc", app.vtoc)
+	g.POST("/console", app.console)
+	g.GET("/console/stream", app.consoleStream)
+	g.GET("/system", app.system)
+	g.GET("/quit", app.quit)
+	g.GET("/capabilities", app.capabilities)
 
 	// Run it
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", config.ListenPort)))
@@ -129,7 +176,10 @@ func realMain(configPath string) int {
 	return 0
 }
 
-func connect(config configuration) (ctccmd, ctcdata ctc.CTC, err error) {
+// connect establishes every pair of CTC adapters in the configuration. The
+// command and data adapters of pair i are device numbers 0x500+2i and
+// 0x501+2i.
+func connect(config configuration) ([]ctcapi.Pair, error) {
 	var hercVer ctc.HerculesVersion
 	var byteOrder binary.ByteOrder
 
@@ -145,67 +195,113 @@ func connect(config configuration) (ctccmd, ctcdata ctc.CTC, err error) {
 		byteOrder = binary.LittleEndian
 	}
 
-	// We need to listen for both CTC connections simultaneously. This is
+	// We need to listen for all CTC connections simultaneously. This is
 	// particularly important for Hercules 3.13, which has absolutely no
-	// re-connection logic, unlike Spinhawk and later. We'll fire both
+	// re-connection logic, unlike Spinhawk and later. We'll fire all the
 	// connection attempts off in goroutines and wait for them.
 
 	var wg sync.WaitGroup
-	var connectError bool
-	wg.Add(2)
+	var connectError atomic.Bool
+	pairs := make([]ctcapi.Pair, len(config.Adapters))
 
-	// Establish the command device connection.
-	go func() {
+	dial := func(dev *ctc.CTC, lport, rport uint16, devnum uint16,
+		name string) {
 		defer wg.Done()
 		var err error // don't race on err from the outer function
-		ctccmd, err = ctc.New(config.CmdLPort, config.CmdRPort, 0x500,
-			config.HerculesHost, hercVer, byteOrder)
+		*dev, err = ctc.New(lport, rport, devnum, config.HerculesHost,
+			hercVer, byteOrder)
 		if err != nil {
-			connectError = true
-			log.Error().Err(err).Msg(
-				"couldn't create CTC command device connection")
-			return
-		}
-
-		if err := ctccmd.Connect(); err != nil {
-			connectError = true
-			log.Error().Err(err).Msg("couldn't create CTC command device")
+			connectError.Store(true)
+			log.Error().Err(err).Msgf(
+				"couldn't create CTC %s device %03x connection", name,
+				devnum)
 			return
 		}
-	}()
 
-	// Establish the data device connection.
-	go func() {
-		defer wg.Done()
-		var err error // don't race on err from the outer function
-		ctcdata, err = ctc.New(config.DataLPort, config.DataRPort, 0x501,
-			config.HerculesHost, hercVer, byteOrder)
-		if err != nil {
-			connectError = true
-			log.Error().Err(err).Msg(
-				"couldn't create CTC data device connection")
+		if err := (*dev).Connect(); err != nil {
+			connectError.Store(true)
+			log.Error().Err(err).Msgf("couldn't connect CTC %s device %03x",
+				name, devnum)
 			return
 		}
+	}
 
-		if err := ctcdata.Connect(); err != nil {
-			connectError = true
-			log.Error().Err(err).Msg("couldn't connect CTC data device")
-			return
-		}
-	}()
+	for i, adapter := range config.Adapters {
+		devnum := uint16(0x500 + 2*i)
+		wg.Add(2)
+		go dial(&pairs[i].Cmd, adapter.CmdLPort, adapter.CmdRPort, devnum,
+			"command")
+		go dial(&pairs[i].Data, adapter.DataLPort, adapter.DataRPort,
+			devnum+1, "data")
+	}
 
 	wg.Wait()
-	if connectError {
-		// We don't know which connection failed, so we'll be careful during
+	if connectError.Load() {
+		// We don't know which connections failed, so we'll be careful during
 		// cleanup.
-		if ctccmd != nil {
-			ctccmd.Close()
+		for _, pair := range pairs {
+			if pair.Cmd != nil {
+				pair.Cmd.Close()
+			}
+			if pair.Data != nil {
+				pair.Data.Close()
+			}
+		}
+		return nil, fmt.Errorf("couldn't connect to Hercules")
+	}
+
+	return pairs, nil
+}
+
+// connectMock creates n pairs of CTC command and data devices that are
+// connected over loopback to an emulation of CTCSERV, serving the datasets in
+// the fixtures directory. This allows development and testing of API clients
+// without a running MVS system.
+func connectMock(fixtures string, n int) ([]ctcapi.Pair, error) {
+	server := mvsmock.New()
+	if err := server.LoadDir(fixtures); err != nil {
+		return nil, fmt.Errorf("couldn't load mock fixtures: %v", err)
+	}
+
+	log.Warn().Msgf("Using mock CTCSERV with fixtures from %s", fixtures)
+
+	var pairs []ctcapi.Pair
+	for i := 0; i < n; i++ {
+		devnum := uint16(0x500 + 2*i)
+		ctccmd, cmdPeer, err := ctctest.NewPair(devnum,
+			ctc.HerculesVersionNew, binary.LittleEndian)
+		if err != nil {
+			closePairs(pairs)
+			return nil, err
 		}
-		if ctcdata != nil {
-			ctcdata.Close()
+		ctcdata, dataPeer, err := ctctest.NewPair(devnum+1,
+			ctc.HerculesVersionNew, binary.LittleEndian)
+		if err != nil {
+			ctccmd.Close()
+			cmdPeer.Close()
+			closePairs(pairs)
+			return nil, err
 		}
-		return nil, nil, fmt.Errorf("couldn't connect to Hercules")
+		pairs = append(pairs, ctcapi.Pair{Cmd: ctccmd, Data: ctcdata})
+
+		go func() {
+			defer cmdPeer.Close()
+			defer dataPeer.Close()
+			err := server.Serve(context.Background(), cmdPeer, dataPeer)
+			if err != nil {
+				log.Error().Err(err).Msgf("mock CTCSERV %d stopped", i)
+				return
+			}
+			log.Info().Msgf("mock CTCSERV %d received quit command", i)
+		}()
 	}
 
-	return ctccmd, ctcdata, nil
+	return pairs, nil
+}
+
+func closePairs(pairs []ctcapi.Pair) {
+	for _, pair := range pairs {
+		pair.Cmd.Close()
+		pair.Data.Close()
+	}
 }